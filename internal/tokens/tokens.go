@@ -0,0 +1,101 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/crc32"
+	"math/big"
+	"strings"
+)
+
+const alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+const checksumLength = 6
+
+// Lowercase letters and digits that cannot be mistaken for each other when read aloud or typed
+const readableAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+
+// Shortest random part accepted, 22 base62 characters carry just over 128 bits
+const MinLength = 22
+
+/*
+Generates an opaque token "<prefix>_<random><checksum>" from crypto/rand
+The random part is length base62 characters and the checksum is the base62 crc32 of the prefix and random part,
+so secret scanners can recognize leaked tokens without talking to the store
+*/
+func Generate(prefix string, length int) (string, error) {
+	random := make([]byte, length)
+	max := big.NewInt(int64(len(alphabet)))
+	for index := range random {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		random[index] = alphabet[n.Int64()]
+	}
+	body := prefix + "_" + string(random)
+	return body + checksum(body), nil
+}
+
+// Generates a code meant to be written down, groups of four readable characters joined by dashes
+func Readable(groups int) (string, error) {
+	random := make([]byte, groups*4)
+	max := big.NewInt(int64(len(readableAlphabet)))
+	for index := range random {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		random[index] = readableAlphabet[n.Int64()]
+	}
+	parts := make([]string, groups)
+	for index := range parts {
+		parts[index] = string(random[index*4 : index*4+4])
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// Undoes what users do to readable codes when typing them: case, spaces and missing dashes
+func NormalizeReadable(code string) string {
+	var normalized []byte
+	for _, char := range []byte(strings.ToLower(code)) {
+		if strings.IndexByte(readableAlphabet, char) >= 0 {
+			normalized = append(normalized, char)
+		}
+	}
+	return string(normalized)
+}
+
+// Checks that the token has the given prefix and a matching checksum
+func Valid(token, prefix string) bool {
+	if !strings.HasPrefix(token, prefix+"_") || len(token) < len(prefix)+1+checksumLength {
+		return false
+	}
+	body := token[:len(token)-checksumLength]
+	return checksum(body) == token[len(token)-checksumLength:]
+}
+
+// Returns the hex sha256 of the token, the only form a token is stored in
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Checks whether the value already is a hash produced by Hash
+func IsHash(value string) bool {
+	if len(value) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+func checksum(body string) string {
+	sum := crc32.ChecksumIEEE([]byte(body))
+	encoded := make([]byte, checksumLength)
+	for index := checksumLength - 1; index >= 0; index-- {
+		encoded[index] = alphabet[sum%uint32(len(alphabet))]
+		sum /= uint32(len(alphabet))
+	}
+	return string(encoded)
+}
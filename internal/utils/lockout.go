@@ -0,0 +1,20 @@
+package utils
+
+import "time"
+
+// Returns how long the nth consecutive lockout lasts, doubling per lockout with backoff and capped at max unless it is 0
+func LockoutDuration(base, max time.Duration, lockouts int, backoff bool) time.Duration {
+	duration := base
+	if backoff {
+		for range lockouts - 1 {
+			duration *= 2
+			if max > 0 && duration >= max || duration <= 0 {
+				return max
+			}
+		}
+	}
+	if max > 0 && duration > max {
+		return max
+	}
+	return duration
+}
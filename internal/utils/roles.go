@@ -0,0 +1,15 @@
+package utils
+
+import "regexp"
+
+var roleNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// Checks that a role name is a single word like "billing-admin"
+func ValidRoleName(name string) bool {
+	return roleNamePattern.MatchString(name)
+}
+
+// Permissions are written like scopes, e.g. "billing:refund", and "*" grants every permission
+func ValidPermission(permission string) bool {
+	return permission == "*" || ValidScope(permission)
+}
@@ -0,0 +1,10 @@
+package utils
+
+import "regexp"
+
+var scopePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+(:[a-zA-Z0-9_.-]+)*$`)
+
+// Checks that a scope is made of colon separated words like "read:profile" or "admin:users"
+func ValidScope(scope string) bool {
+	return scopePattern.MatchString(scope)
+}
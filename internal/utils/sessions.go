@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// Checks a session against the absolute lifetime and idle timeout, 0 disables a limit
+func SessionExpired(now, created, lastSeen time.Time, lifetime, idleTimeout time.Duration) bool {
+	if lifetime > 0 && now.Sub(created) >= lifetime {
+		return true
+	}
+	if idleTimeout > 0 && now.Sub(lastSeen) >= idleTimeout {
+		return true
+	}
+	return false
+}
+
+// Runs the given function every interval in a goroutine until the returned stop function is called
+func Every(interval time.Duration, run func()) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				run()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	once := sync.Once{}
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/constants"
+)
+
+type variable struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Serializes a user variable, supported types: nil, string, bool, int, int64, float64, time.Time, []string, map[string]string
+func EncodeVariable(value any) (string, error) {
+	var typeName string
+	switch value.(type) {
+	case nil:
+		typeName = "nil"
+	case string:
+		typeName = "string"
+	case bool:
+		typeName = "bool"
+	case int:
+		typeName = "int"
+	case int64:
+		typeName = "int64"
+	case float64:
+		typeName = "float64"
+	case time.Time:
+		typeName = "time"
+	case []string:
+		typeName = "[]string"
+	case map[string]string:
+		typeName = "map[string]string"
+	default:
+		return "", fmt.Errorf("%w: %T", constants.ErrUnsupportedVariable, value)
+	}
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.Marshal(variable{Type: typeName, Value: valueBytes})
+	return string(encoded), err
+}
+
+// Deserializes a user variable encoded with EncodeVariable
+func DecodeVariable(encoded string) (any, error) {
+	decoded := variable{}
+	err := json.Unmarshal([]byte(encoded), &decoded)
+	if err != nil {
+		return nil, err
+	}
+	switch decoded.Type {
+	case "nil":
+		return nil, nil
+	case "string":
+		return decodeAs[string](decoded.Value)
+	case "bool":
+		return decodeAs[bool](decoded.Value)
+	case "int":
+		return decodeAs[int](decoded.Value)
+	case "int64":
+		return decodeAs[int64](decoded.Value)
+	case "float64":
+		return decodeAs[float64](decoded.Value)
+	case "time":
+		return decodeAs[time.Time](decoded.Value)
+	case "[]string":
+		return decodeAs[[]string](decoded.Value)
+	case "map[string]string":
+		return decodeAs[map[string]string](decoded.Value)
+	}
+	return nil, fmt.Errorf("%w: %s", constants.ErrUnsupportedVariable, decoded.Type)
+}
+
+// Copies the slices and maps among the supported types so stored variables share nothing with callers
+func CloneVariable(value any) any {
+	switch value := value.(type) {
+	case []string:
+		return slices.Clone(value)
+	case map[string]string:
+		return maps.Clone(value)
+	}
+	return value
+}
+
+func decodeAs[T any](raw json.RawMessage) (any, error) {
+	var value T
+	err := json.Unmarshal(raw, &value)
+	return value, err
+}
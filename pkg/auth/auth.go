@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/webauthn"
+)
+
+// Failed login bookkeeping of an account
+type Lockout struct {
+	FailedAttempts int       // failures since the last successful login or lockout
+	Lockouts       int       // lockouts since the backoff last decayed, drives the exponential backoff
+	LockedUntil    time.Time // zero or in the past when the account is usable
+}
+
+// Reports whether the account is currently locked
+func (lockout Lockout) Locked() bool {
+	return time.Now().Before(lockout.LockedUntil)
+}
+
+// Describes where a login came from, every field is optional
+type Client struct {
+	IP        string
+	UserAgent string
+	Device    string // label chosen by the user, e.g. "work laptop"
+
+	ChallengeSolved bool // set by the caller once the client passed e.g. a captcha the detector asked for, not stored
+}
+
+// Returned by User.EnrollTOTP, hand one of URI or QR to the user's authenticator app
+type TOTPEnrollment struct {
+	Secret string // base32, for manual entry
+	URI    string // otpauth:// URI
+	QR     []byte // PNG of the URI
+}
+
+// A registered passkey as listed by User.Passkeys
+type Passkey struct {
+	ID          string // base64url credential id, pass to User.RemovePasskey
+	Name        string
+	Attestation string // "none" or "packed"
+	Created     time.Time
+	LastUsed    time.Time
+}
+
+// An API key as listed by User.APIKeys
+type APIKey struct {
+	ID       string // sha256 of the key, pass to User.RevokeAPIKey
+	Name     string
+	Access   int // highest access level granted through the key
+	Created  time.Time
+	Expires  time.Time // zero if the key never expires
+	LastUsed time.Time // accurate to about a minute
+}
+
+// A personal access token as listed by User.PersonalTokens
+type PersonalToken struct {
+	ID       string // sha256 of the token, pass to User.RevokePersonalToken
+	Name     string
+	Scopes   []string
+	Created  time.Time
+	Expires  time.Time // zero if the token never expires
+	LastUsed time.Time // accurate to about a minute
+}
+
+// A role as passed to Store.DefineRole and listed by Store.Roles
+type Role struct {
+	Name        string
+	Permissions []string // e.g. "billing:refund", "*" grants every permission
+	Parents     []string // roles whose permissions are inherited
+	BuiltIn     bool     // admin and user, held through the access level
+}
+
+// A session as listed by User.Sessions
+type Session struct {
+	ID       string // sha256 of the session token, pass to User.RevokeSession
+	Created  time.Time
+	LastSeen time.Time
+	Client   Client
+	Current  bool // the session the handle listing them was obtained with
+}
+
+// Store is implemented by every goauthy backend (memory, persistent) so services can be written once
+type Store interface {
+	// Adds new user Add(username, password, access level)
+	Add(username, password string, access int) error
+	// Adds a user with a password hash from another system Import(username, password hash, access level)
+	Import(username, passwordHash string, access int) error
+	// Adds an account that cannot log in and only authenticates with API keys
+	AddServiceAccount(username string, access int) error
+	// Attempts to login with given credentials Login(username, password)
+	Login(username, password string) (User, error)
+	// Same as Login but records the client on the new session
+	LoginWithClient(username, password string, client Client) (User, error)
+	// Returns the failed login state of the account
+	LockoutStatus(username string) (Lockout, error)
+	// Lists the accounts that are currently locked
+	LockedUsers() []string
+	// Clears the failed logins and any lockout of the account
+	Unlock(username string) error
+	// Starts a passkey login, an empty username lets the user pick a discoverable passkey
+	BeginPasskeyLogin(username string) (webauthn.RequestOptions, error)
+	// Finishes a passkey login and returns the user with a new session
+	FinishPasskeyLogin(response webauthn.AssertionResponse, client Client) (User, error)
+	// Marks the email address a verification token was sent to as verified
+	VerifyEmail(token string) error
+	// Sends a single-use password reset token to the user with that username or email address
+	RequestPasswordReset(login string) error
+	// Checks that a reset token is live without using it up
+	CheckReset(token string) error
+	// Sets a new password with a reset token and revokes every session of the user
+	RedeemReset(token, password string) error
+	// Sends a single-use login link to the user with that username or email address
+	RequestMagicLink(login string, bindToBrowser bool) (string, error)
+	// Exchanges a login link token for a session
+	LoginWithMagicLink(token, nonce string, client Client) (User, error)
+	// Creates a role or replaces the permissions and parents it has, refusing inheritance cycles
+	DefineRole(role Role) error
+	// Deletes a role and takes it away from every user
+	DeleteRole(name string) error
+	// Lists every role
+	Roles() []Role
+	// Gets the user object from username
+	UserFromUsername(username string) (User, error)
+	// Gets the user object from session token or API key
+	UserFromID(sessionID string) (User, error)
+	// Revokes the given session tokens
+	RemoveSessions(sessions []string) error
+	// Releases the resources held by the store
+	Close() error
+}
+
+// User is implemented by the user objects returned from a Store
+type User interface {
+	// Returns the user's username
+	Username() string
+	// Returns the user's current session token
+	Session() string
+	// Resets user passsword
+	ChangePassword(password string) error
+	// Returns when the password was last changed
+	PasswordChangedAt() time.Time
+	// Reports whether the user has to change the password before doing anything else
+	PasswordChangeRequired() bool
+	// Forces the user to change the password, existing sessions are restricted to ChangePassword too
+	RequirePasswordChange() error
+	// Starts TOTP enrollment, the secret is only used after ConfirmTOTP
+	EnrollTOTP() (TOTPEnrollment, error)
+	// Activates the enrolled secret once the user proves it with a code
+	ConfirmTOTP(code string) error
+	// Turns TOTP off
+	DisableTOTP() error
+	// Reports whether logins require a TOTP code
+	TOTPEnabled() bool
+	// Checks a TOTP code and upgrades a session returned with ErrMFARequired to a full one
+	VerifyTOTP(code string) error
+	// Replaces the user's recovery codes with a fresh batch, the codes are only returned here
+	GenerateRecoveryCodes() ([]string, error)
+	// Returns how many unused recovery codes are left
+	RecoveryCodesLeft() int
+	// Uses up a recovery code, works wherever VerifyTOTP does
+	VerifyRecoveryCode(code string) error
+	// Starts registering a passkey, pass the options to navigator.credentials.create
+	BeginPasskeyRegistration() (webauthn.CreationOptions, error)
+	// Verifies the authenticator's response and stores the passkey under name
+	FinishPasskeyRegistration(name string, response webauthn.RegistrationResponse) error
+	// Lists the user's passkeys
+	Passkeys() ([]Passkey, error)
+	// Removes one of the user's passkeys
+	RemovePasskey(id string) error
+	// Returns the user's email address, empty if none was set
+	Email() string
+	// Sets or clears the email address, a new address starts unverified
+	SetEmail(email string) error
+	// Reports whether the user proved they own the email address
+	EmailVerified() bool
+	// Mails a verification token for the current email address
+	SendEmailVerification() error
+	// Reports whether the user is a service account without a password
+	IsServiceAccount() bool
+	// Creates an API key with an access ceiling and optional expiry, the key is only returned here
+	CreateAPIKey(name string, access int, expires time.Time) (string, error)
+	// Lists the user's API keys
+	APIKeys() ([]APIKey, error)
+	// Revokes one of the user's API keys
+	RevokeAPIKey(id string) error
+	// Creates a personal access token limited to scopes, the token is only returned here
+	CreatePersonalToken(name string, scopes []string, expires time.Time) (string, error)
+	// Lists the user's personal access tokens
+	PersonalTokens() ([]PersonalToken, error)
+	// Revokes one of the user's personal access tokens
+	RevokePersonalToken(id string) error
+	// Reports whether the scope was granted, only personal access tokens are limited
+	HasScope(scope string) bool
+	// Checks the access level and the scope together
+	CheckScopedAccess(accessLevel int, scope string) bool
+	// Deletes the user's current session
+	LogOut() error
+	// Deletes all user sessions
+	LogOutFully() error
+	// Lists the user's live sessions with their metadata
+	Sessions() ([]Session, error)
+	// Revokes one of the user's sessions
+	RevokeSession(sessionID string) error
+	// Deletes the user
+	Delete() error
+	// Checks whether user has X level of access
+	CheckAccess(accessLevel int) bool
+	// Changes access level to the desired one
+	ChangeAccess(accessLevel int) error
+	// Gives the user a role created with DefineRole
+	GrantRole(name string) error
+	// Takes a granted role away from the user
+	RevokeRole(name string) error
+	// Returns the user's roles, the built-in role of its access level first
+	Roles() []string
+	// Checks whether one of the user's roles grants the permission
+	HasPermission(permission string) bool
+	// Sets a user variable, supported types: nil, string, bool, int, int64, float64, time.Time, []string, map[string]string
+	SetVariable(key string, value any) error
+	// Gets a user variable
+	GetVariable(key string) (any, bool)
+	// Deletes a user variable
+	DeleteVariable(key string) error
+}
@@ -9,8 +9,34 @@ const PUBLIC = -1
 const ADMIN = 0
 const USER = 1
 
+// Built-in roles the access levels map onto, a user holds the one matching its access level
+const ADMIN_ROLE = "admin"
+const USER_ROLE = "user"
+
 var ErrInvalidUsernamePassword = errors.New("the username or password is empty or contained characters that are not allowed")
 var ErrNotFound = errors.New("not found")
 var ErrAlreadyExists = errors.New("user already exists")
 var ErrNotAllowed = errors.New("this action is not permitted")
 var ErrAlreadyAuthenticated = errors.New("user already signed in, multiple session disabled")
+var ErrInvalidOption = errors.New("invalid store option")
+var ErrUnsupportedVariable = errors.New("variable type is not supported")
+var ErrSessionExpired = errors.New("session expired")
+var ErrInvalidCredentials = errors.New("invalid username or password")
+var ErrPasswordPolicy = errors.New("the password does not meet the password policy")
+var ErrPasswordReused = errors.New("the password was used recently")
+var ErrPasswordChangeRequired = errors.New("the password has to be changed before continuing")
+var ErrAccountLocked = errors.New("the account is locked after too many failed logins")
+var ErrSourceBlocked = errors.New("too many failed logins from this source")
+var ErrChallengeRequired = errors.New("the source must solve a challenge before logging in")
+var ErrMFARequired = errors.New("a second factor is required to complete the login")
+var ErrInvalidCode = errors.New("invalid or already used code")
+var ErrPasskeysDisabled = errors.New("passkeys are not configured")
+var ErrInvalidChallenge = errors.New("unknown or expired challenge")
+var ErrTooManyChallenges = errors.New("too many passkey ceremonies are pending, try again later")
+var ErrInvalidEmail = errors.New("invalid email address")
+var ErrEmailNotVerified = errors.New("the email address has to be verified before logging in")
+var ErrNoMailer = errors.New("no mailer or notifier configured")
+var ErrInvalidToken = errors.New("invalid, expired or already used token")
+var ErrInvalidScope = errors.New("unknown or malformed scope")
+var ErrInvalidRole = errors.New("malformed role name or permission")
+var ErrRoleCycle = errors.New("the role would inherit from itself")
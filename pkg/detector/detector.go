@@ -0,0 +1,183 @@
+package detector
+
+import (
+	"sync"
+	"time"
+)
+
+// What a source is allowed to do, returned by Detector.Check
+type Verdict int
+
+const (
+	Allow Verdict = iota
+	Challenge
+	Block
+)
+
+func (verdict Verdict) String() string {
+	switch verdict {
+	case Challenge:
+		return "challenge"
+	case Block:
+		return "block"
+	}
+	return "allow"
+}
+
+// Emitted once when a source starts being challenged or blocked
+type Event struct {
+	Source   string
+	Verdict  Verdict
+	Failures int      // failed logins of the source within the window
+	Accounts []string // distinct usernames the source failed against within the window
+	Time     time.Time
+}
+
+type Settings struct {
+	Window         time.Duration //  default:10m  how far back failures are counted
+	ChallengeAfter int           //  0 = never  distinct accounts failed from one source before it must pass a challenge
+	BlockAfter     int           //  0 = never  distinct accounts failed from one source before it is blocked
+	BlockDuration  time.Duration //  default:Window  how long a blocked source stays blocked
+	OnEvent        func(Event)   //  optional, e.g. to alert a security team
+}
+
+type failure struct {
+	username string
+	time     time.Time
+}
+
+type source struct {
+	failures     []failure
+	verdict      Verdict // last verdict an event was emitted for
+	blockedUntil time.Time
+}
+
+/*
+Tracks failed logins per source (usually the client IP) across all accounts,
+a source failing against many different usernames is stuffing credentials or spraying a password
+detector.New(detector.Settings{ChallengeAfter: 5, BlockAfter: 20})
+*/
+type Detector struct {
+	settings  Settings
+	lock      sync.Mutex
+	sources   map[string]*source
+	lastSweep time.Time
+}
+
+// Creates a detector, zero durations fall back to their defaults
+func New(settings Settings) *Detector {
+	if settings.Window <= 0 {
+		settings.Window = 10 * time.Minute
+	}
+	if settings.BlockDuration <= 0 {
+		settings.BlockDuration = settings.Window
+	}
+	return &Detector{settings: settings, sources: make(map[string]*source), lastSweep: time.Now()}
+}
+
+// Returns what the source may do, an empty source or a nil detector always allows
+func (detector *Detector) Check(sourceID string) Verdict {
+	if detector == nil || sourceID == "" {
+		return Allow
+	}
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	source, ok := detector.sources[sourceID]
+	if !ok {
+		return Allow
+	}
+	return detector.verdict(source, time.Now())
+}
+
+// Records a failed login of the source against username and emits an event if the source crossed a threshold
+func (detector *Detector) Failure(sourceID, username string) {
+	if detector == nil || sourceID == "" {
+		return
+	}
+	now := time.Now()
+	detector.lock.Lock()
+	detector.sweep(now)
+	src, ok := detector.sources[sourceID]
+	if !ok {
+		src = &source{}
+		detector.sources[sourceID] = src
+	}
+	src.failures = append(src.failures, failure{username: username, time: now})
+	verdict := detector.verdict(src, now)
+	var event *Event
+	if verdict > src.verdict {
+		src.verdict = verdict
+		if verdict == Block {
+			src.blockedUntil = now.Add(detector.settings.BlockDuration)
+		}
+		event = &Event{Source: sourceID, Verdict: verdict, Failures: len(src.failures), Accounts: accounts(src), Time: now}
+	}
+	detector.lock.Unlock()
+
+	if event != nil && detector.settings.OnEvent != nil {
+		detector.settings.OnEvent(*event)
+	}
+}
+
+// Forgets everything about the source, e.g. after a false positive
+func (detector *Detector) Reset(sourceID string) {
+	if detector == nil {
+		return
+	}
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	delete(detector.sources, sourceID)
+}
+
+// Drops failures outside the window and works out the verdict, the caller must hold the lock
+func (detector *Detector) verdict(src *source, now time.Time) Verdict {
+	cutoff := now.Add(-detector.settings.Window)
+	kept := src.failures[:0]
+	for _, failure := range src.failures {
+		if failure.time.After(cutoff) {
+			kept = append(kept, failure)
+		}
+	}
+	src.failures = kept
+
+	if now.Before(src.blockedUntil) {
+		return Block
+	}
+	distinct := len(accounts(src))
+	verdict := Allow
+	if detector.settings.BlockAfter > 0 && distinct >= detector.settings.BlockAfter {
+		verdict = Block
+	} else if detector.settings.ChallengeAfter > 0 && distinct >= detector.settings.ChallengeAfter {
+		verdict = Challenge
+	}
+	if verdict < src.verdict {
+		// cooled down, the next escalation emits a fresh event
+		src.verdict = verdict
+	}
+	return verdict
+}
+
+// Removes sources without failures in the window at most once per window, the caller must hold the lock
+func (detector *Detector) sweep(now time.Time) {
+	if now.Sub(detector.lastSweep) < detector.settings.Window {
+		return
+	}
+	detector.lastSweep = now
+	for sourceID, src := range detector.sources {
+		if detector.verdict(src, now) == Allow && len(src.failures) == 0 {
+			delete(detector.sources, sourceID)
+		}
+	}
+}
+
+func accounts(src *source) []string {
+	seen := make(map[string]bool)
+	var usernames []string
+	for _, failure := range src.failures {
+		if !seen[failure.username] {
+			seen[failure.username] = true
+			usernames = append(usernames, failure.username)
+		}
+	}
+	return usernames
+}
@@ -0,0 +1,85 @@
+package hasher
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id encoded as $argon2id$v=19$m=65536,t=3,p=4$salt$hash
+type Argon2id struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Highest memory cost in KiB accepted from a stored hash, a forged hash could otherwise exhaust the host
+const maxArgon2idMemory = 4 * 1024 * 1024
+
+// argon2id with the RFC 9106 second recommended parameters (64 MiB, 3 passes)
+func NewArgon2id() *Argon2id {
+	return &Argon2id{Memory: 64 * 1024, Iterations: 3, Parallelism: 4, SaltLength: 16, KeyLength: 32}
+}
+
+func (hasher *Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, hasher.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, hasher.Iterations, hasher.Memory, hasher.Parallelism, hasher.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, hasher.Memory, hasher.Iterations, hasher.Parallelism, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (hasher *Argon2id) Recognizes(encoded string) bool {
+	_, err := phcFields(encoded, "argon2id", 4)
+	return err != ErrUnknownHash
+}
+
+func (hasher *Argon2id) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return equal(computed, key), nil
+}
+
+func (hasher *Argon2id) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Memory != hasher.Memory || params.Iterations != hasher.Iterations || params.Parallelism != hasher.Parallelism ||
+		uint32(len(salt)) != hasher.SaltLength || uint32(len(key)) != hasher.KeyLength
+}
+
+func decodeArgon2id(encoded string) (*Argon2id, []byte, []byte, error) {
+	fields, err := phcFields(encoded, "argon2id", 4)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var version int
+	_, err = fmt.Sscanf(fields[0], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrMalformedHash
+	}
+	params := &Argon2id{}
+	_, err = fmt.Sscanf(fields[1], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil || params.Iterations < 1 || params.Parallelism < 1 || params.Memory > maxArgon2idMemory {
+		return nil, nil, nil, ErrMalformedHash
+	}
+	salt, err := b64.DecodeString(fields[2])
+	if err != nil {
+		return nil, nil, nil, ErrMalformedHash
+	}
+	key, err := b64.DecodeString(fields[3])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, ErrMalformedHash
+	}
+	return params, salt, key, nil
+}
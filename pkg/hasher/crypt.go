@@ -0,0 +1,219 @@
+package hasher
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// MD5-crypt as used by Apache htpasswd ($apr1$) and old Linux shadow files ($1$)
+type MD5Crypt struct{}
+
+func (verifier *MD5Crypt) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$apr1$") || strings.HasPrefix(encoded, "$1$")
+}
+
+func (verifier *MD5Crypt) Verify(password, encoded string) (bool, error) {
+	magic := "$1$"
+	if strings.HasPrefix(encoded, "$apr1$") {
+		magic = "$apr1$"
+	}
+	fields := strings.Split(encoded[len(magic):], "$")
+	if len(fields) != 2 {
+		return false, ErrMalformedHash
+	}
+	salt := fields[0]
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	return equal([]byte(md5Crypt([]byte(password), []byte(salt), magic)), []byte(encoded)), nil
+}
+
+func md5Crypt(password, salt []byte, magic string) string {
+	alternate := md5.New()
+	alternate.Write(password)
+	alternate.Write(salt)
+	alternate.Write(password)
+	mixin := alternate.Sum(nil)
+
+	digest := md5.New()
+	digest.Write(password)
+	digest.Write([]byte(magic))
+	digest.Write(salt)
+	for length := len(password); length > 0; length -= 16 {
+		digest.Write(mixin[:min(length, 16)])
+	}
+	for length := len(password); length > 0; length >>= 1 {
+		if length&1 == 1 {
+			digest.Write([]byte{0})
+		} else {
+			digest.Write(password[:1])
+		}
+	}
+	final := digest.Sum(nil)
+
+	for round := 0; round < 1000; round++ {
+		digest := md5.New()
+		if round&1 == 1 {
+			digest.Write(password)
+		} else {
+			digest.Write(final)
+		}
+		if round%3 != 0 {
+			digest.Write(salt)
+		}
+		if round%7 != 0 {
+			digest.Write(password)
+		}
+		if round&1 == 1 {
+			digest.Write(final)
+		} else {
+			digest.Write(password)
+		}
+		final = digest.Sum(nil)
+	}
+
+	encoded := []byte(magic + string(salt) + "$")
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encoded = cryptEncode(encoded, final[group[0]], final[group[1]], final[group[2]], 4)
+	}
+	return string(cryptEncode(encoded, 0, 0, final[11], 2))
+}
+
+// SHA-crypt as used by Linux shadow files, $5$ for SHA-256 and $6$ for SHA-512
+type SHACrypt struct{}
+
+func (verifier *SHACrypt) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$5$") || strings.HasPrefix(encoded, "$6$")
+}
+
+func (verifier *SHACrypt) Verify(password, encoded string) (bool, error) {
+	newHash, permutation := sha256.New, sha256Permutation
+	if strings.HasPrefix(encoded, "$6$") {
+		newHash, permutation = sha512.New, sha512Permutation
+	}
+	magic := encoded[:3]
+	fields := strings.Split(encoded[3:], "$")
+	rounds, roundsField := 5000, ""
+	if len(fields) == 3 && strings.HasPrefix(fields[0], "rounds=") {
+		parsed, err := strconv.Atoi(strings.TrimPrefix(fields[0], "rounds="))
+		if err != nil {
+			return false, ErrMalformedHash
+		}
+		rounds, roundsField = min(max(parsed, 1000), 999999999), fields[0]+"$"
+		fields = fields[1:]
+	}
+	if len(fields) != 2 {
+		return false, ErrMalformedHash
+	}
+	salt := fields[0]
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	digest := shaCrypt(newHash, []byte(password), []byte(salt), rounds)
+	computed := []byte(magic + roundsField + salt + "$")
+	last := len(permutation) - 1
+	for _, group := range permutation[:last] {
+		computed = cryptEncode(computed, digest[group[0]], digest[group[1]], digest[group[2]], 4)
+	}
+	if len(digest) == sha512.Size {
+		computed = cryptEncode(computed, 0, 0, digest[permutation[last][2]], 2)
+	} else {
+		computed = cryptEncode(computed, 0, digest[permutation[last][1]], digest[permutation[last][2]], 3)
+	}
+	return equal(computed, []byte(encoded)), nil
+}
+
+func shaCrypt(newHash func() hash.Hash, password, salt []byte, rounds int) []byte {
+	alternate := newHash()
+	alternate.Write(password)
+	alternate.Write(salt)
+	alternate.Write(password)
+	mixin := alternate.Sum(nil)
+
+	digest := newHash()
+	digest.Write(password)
+	digest.Write(salt)
+	length := len(password)
+	for ; length > len(mixin); length -= len(mixin) {
+		digest.Write(mixin)
+	}
+	digest.Write(mixin[:length])
+	for length := len(password); length > 0; length >>= 1 {
+		if length&1 == 1 {
+			digest.Write(mixin)
+		} else {
+			digest.Write(password)
+		}
+	}
+	final := digest.Sum(nil)
+
+	passwordDigest := newHash()
+	for range password {
+		passwordDigest.Write(password)
+	}
+	pSequence := repeatTo(passwordDigest.Sum(nil), len(password))
+
+	saltDigest := newHash()
+	for range 16 + int(final[0]) {
+		saltDigest.Write(salt)
+	}
+	sSequence := repeatTo(saltDigest.Sum(nil), len(salt))
+
+	for round := 0; round < rounds; round++ {
+		digest := newHash()
+		if round&1 == 1 {
+			digest.Write(pSequence)
+		} else {
+			digest.Write(final)
+		}
+		if round%3 != 0 {
+			digest.Write(sSequence)
+		}
+		if round%7 != 0 {
+			digest.Write(pSequence)
+		}
+		if round&1 == 1 {
+			digest.Write(final)
+		} else {
+			digest.Write(pSequence)
+		}
+		final = digest.Sum(nil)
+	}
+	return final
+}
+
+var sha256Permutation = [][3]int{
+	{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+	{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29}, {0, 31, 30},
+}
+
+var sha512Permutation = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+	{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+	{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+	{0, 0, 63},
+}
+
+func repeatTo(block []byte, length int) []byte {
+	sequence := make([]byte, 0, length)
+	for len(sequence) < length {
+		sequence = append(sequence, block[:min(len(block), length-len(sequence))]...)
+	}
+	return sequence
+}
+
+// Appends n characters of the crypt(3) base64 encoding of the 24 bit group b2 b1 b0
+func cryptEncode(dst []byte, b2, b1, b0 byte, n int) []byte {
+	group := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for range n {
+		dst = append(dst, cryptAlphabet[group&0x3f])
+		group >>= 6
+	}
+	return dst
+}
@@ -0,0 +1,125 @@
+package hasher
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownHash = errors.New("the password hash is in an unknown format")
+var ErrMalformedHash = errors.New("the password hash is malformed")
+var ErrInvalidParameters = errors.New("the hasher parameters are invalid")
+
+// Reads one family of encoded password hashes
+type Verifier interface {
+	// Reports whether the encoded hash is in a format this verifier reads
+	Recognizes(encoded string) bool
+	// Checks the password against the encoded hash
+	Verify(password, encoded string) (bool, error)
+}
+
+// Hashes new passwords, stores pick one as their primary hasher
+type PasswordHasher interface {
+	Verifier
+	// Hashes the password into a self-describing string ($2a$..., $argon2id$..., $scrypt$...)
+	Hash(password string) (string, error)
+	// Reports whether the hash uses another algorithm or outdated parameters and should be replaced
+	NeedsRehash(encoded string) bool
+}
+
+/*
+Checks the parameters of the hashers of this package before a store hashes with them
+Other PasswordHasher implementations are not checked
+*/
+func Validate(passwordHasher PasswordHasher) error {
+	switch passwordHasher := passwordHasher.(type) {
+	case *Bcrypt:
+		if passwordHasher.Cost != 0 && (passwordHasher.Cost < bcrypt.MinCost || passwordHasher.Cost > bcrypt.MaxCost) {
+			return fmt.Errorf("%w: bcrypt cost must be between %d and %d", ErrInvalidParameters, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case *Argon2id:
+		if passwordHasher.Iterations < 1 || passwordHasher.Parallelism < 1 || passwordHasher.Memory > maxArgon2idMemory {
+			return fmt.Errorf("%w: argon2id needs at least one iteration and thread and at most %d KiB of memory", ErrInvalidParameters, maxArgon2idMemory)
+		}
+		if passwordHasher.SaltLength < minSaltLength || passwordHasher.KeyLength < minKeyLength {
+			return fmt.Errorf("%w: argon2id salt must be at least %d and key at least %d bytes", ErrInvalidParameters, minSaltLength, minKeyLength)
+		}
+	case *Scrypt:
+		if !passwordHasher.validCost() {
+			return fmt.Errorf("%w: scrypt needs LogN between 1 and 31, positive r and p with r*p below 2^30 and at most %d bytes of memory", ErrInvalidParameters, maxScryptMemory)
+		}
+		if passwordHasher.SaltLength < minSaltLength || passwordHasher.KeyLength < minKeyLength {
+			return fmt.Errorf("%w: scrypt salt must be at least %d and key at least %d bytes", ErrInvalidParameters, minSaltLength, minKeyLength)
+		}
+	}
+	return nil
+}
+
+// Shortest salt and key in bytes Validate accepts for argon2id and scrypt
+const (
+	minSaltLength = 8
+	minKeyLength  = 16
+)
+
+var lock sync.RWMutex
+
+/*
+Verify understands every hasher of this package plus hashes imported from other systems:
+Django pbkdf2_sha256, htpasswd $apr1$ and {SHA}, $1$/$5$/$6$ crypt and salted {SSHA*}
+Legacy hashes can only be verified, stores replace them with their primary hasher on the next login
+*/
+var verifiers = []Verifier{&Bcrypt{}, &Argon2id{}, &Scrypt{}, &DjangoPBKDF2{}, &MD5Crypt{}, &SHACrypt{}, &SaltedSHA{}}
+
+// Adds a verifier consulted by Verify, e.g. for hashes imported from another system
+func Register(verifier Verifier) {
+	lock.Lock()
+	defer lock.Unlock()
+	verifiers = append(verifiers, verifier)
+}
+
+// Reports whether any registered verifier reads the encoded hash
+func Supported(encoded string) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	for _, verifier := range verifiers {
+		if verifier.Recognizes(encoded) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the password against an encoded hash of any registered format
+func Verify(password, encoded string) (bool, error) {
+	lock.RLock()
+	defer lock.RUnlock()
+	for _, verifier := range verifiers {
+		if verifier.Recognizes(encoded) {
+			return verifier.Verify(password, encoded)
+		}
+	}
+	return false, ErrUnknownHash
+}
+
+var b64 = base64.RawStdEncoding
+
+func equal(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// Splits a PHC string "$id$params$salt$hash" into its fields after the id
+func phcFields(encoded, id string, count int) ([]string, error) {
+	if !strings.HasPrefix(encoded, "$"+id+"$") {
+		return nil, ErrUnknownHash
+	}
+	fields := strings.Split(encoded[len(id)+2:], "$")
+	if len(fields) != count {
+		return nil, ErrMalformedHash
+	}
+	return fields, nil
+}
@@ -0,0 +1,79 @@
+package hasher
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Django's default hasher, pbkdf2_sha256$iterations$salt$base64 hash
+type DjangoPBKDF2 struct{}
+
+func (verifier *DjangoPBKDF2) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "pbkdf2_sha256$")
+}
+
+func (verifier *DjangoPBKDF2) Verify(password, encoded string) (bool, error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 4 {
+		return false, ErrMalformedHash
+	}
+	iterations, err := strconv.Atoi(fields[1])
+	if err != nil || iterations < 1 {
+		return false, ErrMalformedHash
+	}
+	key, err := base64.StdEncoding.DecodeString(fields[3])
+	if err != nil || len(key) == 0 {
+		return false, ErrMalformedHash
+	}
+	computed := pbkdf2.Key([]byte(password), []byte(fields[2]), iterations, len(key), sha256.New)
+	return equal(computed, key), nil
+}
+
+// LDAP style {SHA}, {SSHA}, {SSHA256} and {SSHA512} hashes as found in htpasswd files and directory exports
+type SaltedSHA struct{}
+
+var saltedSHASchemes = []struct {
+	prefix  string
+	newHash func() hash.Hash
+	size    int
+	salted  bool
+}{
+	{"{SHA}", sha1.New, sha1.Size, false},
+	{"{SSHA}", sha1.New, sha1.Size, true},
+	{"{SSHA256}", sha256.New, sha256.Size, true},
+	{"{SSHA512}", sha512.New, sha512.Size, true},
+}
+
+func (verifier *SaltedSHA) Recognizes(encoded string) bool {
+	for _, scheme := range saltedSHASchemes {
+		if strings.HasPrefix(encoded, scheme.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (verifier *SaltedSHA) Verify(password, encoded string) (bool, error) {
+	for _, scheme := range saltedSHASchemes {
+		if !strings.HasPrefix(encoded, scheme.prefix) {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded[len(scheme.prefix):])
+		if err != nil || len(decoded) < scheme.size || (!scheme.salted && len(decoded) != scheme.size) {
+			return false, ErrMalformedHash
+		}
+		digest, salt := decoded[:scheme.size], decoded[scheme.size:]
+		computed := scheme.newHash()
+		computed.Write([]byte(password))
+		computed.Write(salt)
+		return equal(computed.Sum(nil), digest), nil
+	}
+	return false, ErrUnknownHash
+}
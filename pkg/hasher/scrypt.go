@@ -0,0 +1,94 @@
+package hasher
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt encoded as $scrypt$ln=15,r=8,p=1$salt$hash, N is 2^LogN
+type Scrypt struct {
+	LogN       uint8
+	R          int
+	P          int
+	SaltLength int
+	KeyLength  int
+}
+
+// Highest memory in bytes (128*r*N) accepted from a stored hash, a forged hash could otherwise exhaust the host
+const maxScryptMemory = 4 << 30
+
+// scrypt with N=2^15, r=8, p=1
+func NewScrypt() *Scrypt {
+	return &Scrypt{LogN: 15, R: 8, P: 1, SaltLength: 16, KeyLength: 32}
+}
+
+func (hasher *Scrypt) Hash(password string) (string, error) {
+	salt := make([]byte, hasher.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<hasher.LogN, hasher.R, hasher.P, hasher.KeyLength)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		hasher.LogN, hasher.R, hasher.P, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (hasher *Scrypt) Recognizes(encoded string) bool {
+	_, err := phcFields(encoded, "scrypt", 3)
+	return err != ErrUnknownHash
+}
+
+func (hasher *Scrypt) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := decodeScrypt(encoded)
+	if err != nil {
+		return false, err
+	}
+	computed, err := scrypt.Key([]byte(password), salt, 1<<params.LogN, params.R, params.P, len(key))
+	if err != nil {
+		return false, err
+	}
+	return equal(computed, key), nil
+}
+
+func (hasher *Scrypt) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeScrypt(encoded)
+	if err != nil {
+		return true
+	}
+	return params.LogN != hasher.LogN || params.R != hasher.R || params.P != hasher.P ||
+		len(salt) != hasher.SaltLength || len(key) != hasher.KeyLength
+}
+
+func decodeScrypt(encoded string) (*Scrypt, []byte, []byte, error) {
+	fields, err := phcFields(encoded, "scrypt", 3)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	params := &Scrypt{}
+	_, err = fmt.Sscanf(fields[0], "ln=%d,r=%d,p=%d", &params.LogN, &params.R, &params.P)
+	if err != nil || !params.validCost() {
+		return nil, nil, nil, ErrMalformedHash
+	}
+	salt, err := b64.DecodeString(fields[1])
+	if err != nil {
+		return nil, nil, nil, ErrMalformedHash
+	}
+	key, err := b64.DecodeString(fields[2])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, ErrMalformedHash
+	}
+	return params, salt, key, nil
+}
+
+// Reports whether N, r and p are accepted by scrypt.Key and stay below maxScryptMemory
+func (hasher *Scrypt) validCost() bool {
+	if hasher.LogN == 0 || hasher.LogN > 31 || hasher.R <= 0 || hasher.P <= 0 || hasher.R*hasher.P >= 1<<30 {
+		return false
+	}
+	return uint64(hasher.R) <= maxScryptMemory/(128<<hasher.LogN)
+}
@@ -0,0 +1,81 @@
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Delivers messages the store sends to users, implement it for SMTP or an email API
+type Mailer interface {
+	Send(message Message) error
+}
+
+// Keeps every message in memory, meant for tests
+type Memory struct {
+	lock     sync.Mutex
+	messages []Message
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (memory *Memory) Send(message Message) error {
+	memory.lock.Lock()
+	defer memory.lock.Unlock()
+	memory.messages = append(memory.messages, message)
+	return nil
+}
+
+// Returns every message sent so far
+func (memory *Memory) Messages() []Message {
+	memory.lock.Lock()
+	defer memory.lock.Unlock()
+	return append([]Message(nil), memory.messages...)
+}
+
+// Returns the newest message sent to the address
+func (memory *Memory) Last(to string) (Message, bool) {
+	memory.lock.Lock()
+	defer memory.lock.Unlock()
+	for index := len(memory.messages) - 1; index >= 0; index-- {
+		if strings.EqualFold(memory.messages[index].To, to) {
+			return memory.messages[index], true
+		}
+	}
+	return Message{}, false
+}
+
+// Writes every message as an .eml file into a directory, handy during development
+type Directory struct {
+	path string
+}
+
+func NewDirectory(path string) (*Directory, error) {
+	err := os.MkdirAll(path, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	return &Directory{path: path}, nil
+}
+
+func (directory *Directory) Send(message Message) error {
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.Map(func(char rune) rune {
+		if char == '/' || char == '\\' || char == os.PathSeparator {
+			return '_'
+		}
+		return char
+	}, message.To))
+	content := "To: " + message.To + "\r\nSubject: " + message.Subject + "\r\n\r\n" + message.Body + "\r\n"
+	return os.WriteFile(filepath.Join(directory.path, name), []byte(content), 0o600)
+}
@@ -1,17 +1,53 @@
 package memory
 
 import (
+	"crypto/subtle"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/Varppi/goauthy/internal/tokens"
 	"github.com/Varppi/goauthy/internal/utils"
+	"github.com/Varppi/goauthy/pkg/auth"
 	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/hasher"
+	"github.com/Varppi/goauthy/pkg/mailer"
+	"github.com/Varppi/goauthy/pkg/notifier"
+	"github.com/Varppi/goauthy/pkg/totp"
 )
 
+/*
+Sessions are keyed by the sha256 of their token, the token itself only lives in the user object
+handed out by Login so a leaked store or database cannot be replayed
+*/
 type store struct { //Single source of truth
-	lock     sync.Mutex
-	users    map[string]*User
-	sessions map[string]*User
-	options  *Options
+	lock           sync.Mutex
+	users          map[string]*account
+	sessions       map[string]*session
+	options        *Options
+	stopReaper     func()
+	challenges     map[string]*challenge // pending passkey ceremonies by challenge
+	challengeSweep time.Time             // when expired challenges are dropped next
+	resets         map[string]*reset     // password reset tokens by hash
+	magicLinks     map[string]*magicLink // login link tokens by hash
+	roles          map[string]*role      // roles by name, built-in ones included
+	roleGeneration uint64                // bumped on every role definition change, invalidating the users' permission caches
+}
+
+type reset struct {
+	username string
+	expires  time.Time
+}
+
+type session struct {
+	user     *account
+	created  time.Time
+	lastSeen time.Time
+	client   auth.Client
+
+	pendingMFA bool // only VerifyTOTP may use the session
 }
 
 func (store *store) get(username string) (*User, error) {
@@ -19,13 +55,23 @@ func (store *store) get(username string) (*User, error) {
 	defer store.lock.Unlock()
 	for _, user := range store.users {
 		if user.username == username {
-			return user, nil
+			return &User{account: user}, nil
 		}
 	}
-	return &User{}, constants.ErrNotFound
+	return &User{account: &account{}}, constants.ErrNotFound
 }
 
 func (store *store) add(user *User) error {
+	passHash, err := store.options.hasher.Hash(user.password)
+	if err != nil {
+		return err
+	}
+	user.password = passHash
+	return store.insert(user)
+}
+
+// Stores a user whose password is already hashed
+func (store *store) insert(user *User) error {
 	store.lock.Lock()
 	defer store.lock.Unlock()
 	for username := range store.users {
@@ -33,32 +79,518 @@ func (store *store) add(user *User) error {
 			return constants.ErrAlreadyExists
 		}
 	}
-	passHash, err := utils.HashPassword(user.password)
-	if err != nil {
-		return err
-	}
-	user.password = passHash
-	store.users[user.username] = user
+	store.users[user.username] = user.account
 	return nil
 }
 
-func (store *store) remove(user *User) {
+// Removes the user with everything issued to them and clears the shared account so other handles stop working
+func (store *store) remove(user *User) error {
 	store.lock.Lock()
 	defer store.lock.Unlock()
-	store.RemoveSessions(user.getSessions())
+	for _, session := range store.userSessions(user) {
+		delete(store.sessions, session)
+	}
 	for username := range store.users {
 		if user.username == username {
 			delete(store.users, username)
 		}
 	}
+	store.dropResets(user.username)
+	store.dropMagicLinks(user.username)
+	user.password = ""
+	user.username = ""
+	user.access = -1
+	user.variables = nil
+	return nil
+}
+
+// Sets a new password chosen by the user, the replaced hash moves into the password history
+func (store *store) changePassword(user *User, passHash string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	user.history = store.rememberPassword(user)
+	user.password = passHash
+	user.passwordChanged = time.Now()
+	user.mustChangePassword = false
+	return nil
+}
+
+func (store *store) requirePasswordChange(user *User) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	user.mustChangePassword = true
+	return nil
+}
+
+// Swaps the hash of the unchanged password, e.g. when upgrading the hashing algorithm
+func (store *store) replaceHash(user *User, passHash string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	user.password = passHash
+	return nil
+}
+
+// Changes the access level, keys and personal access tokens reaching above it are lowered to it
+func (store *store) changeAccess(user *User, access int) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	user.access = access
+	for _, key := range user.apiKeys {
+		key.access = max(key.access, access)
+	}
+	return nil
+}
+
+// Returns the history after the current hash is replaced, newest first and trimmed to the configured length
+func (store *store) rememberPassword(user *User) []string {
+	keep := store.options.UserSettings.PasswordHistory - 1
+	if keep <= 0 {
+		return nil
+	}
+	history := append([]string{user.password}, user.history...)
+	if len(history) > keep {
+		history = history[:keep]
+	}
+	return history
+}
+
+// Checks whether the password is the current one or in the history
+func (store *store) reusedPassword(user *User, password string) bool {
+	if store.options.UserSettings.PasswordHistory <= 0 {
+		return false
+	}
+	store.lock.Lock()
+	hashes := append([]string{user.password}, user.history...)
+	store.lock.Unlock()
+	for _, passHash := range hashes {
+		ok, _ := hasher.Verify(password, passHash)
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts a failed login and locks the account once the threshold is reached
+func (store *store) loginFailed(user *User) error {
+	settings := store.options.UserSettings
+	if settings.LockoutThreshold <= 0 {
+		return nil
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	lockout := user.lockout
+	lockout.FailedAttempts++
+	if lockout.FailedAttempts >= settings.LockoutThreshold {
+		decay := settings.LockoutDecay
+		if decay == 0 {
+			decay = 24 * time.Hour
+		}
+		if time.Since(lockout.LockedUntil) >= decay {
+			lockout.Lockouts = 0
+		}
+		lockout.Lockouts++
+		lockout.FailedAttempts = 0
+		duration := utils.LockoutDuration(settings.LockoutDuration, settings.LockoutMaxDuration, lockout.Lockouts, settings.LockoutBackoff)
+		lockout.LockedUntil = time.Now().Add(duration)
+	}
+	return store.saveLockout(user, lockout)
+}
+
+// Reports whether the account is locked out right now
+func (store *store) locked(user *User) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return user.lockout.Locked()
+}
+
+// Forgets the failed attempts after a successful login, the lockouts driving the backoff only decay
+func (store *store) resetFailures(user *User) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if user.lockout.FailedAttempts == 0 {
+		return nil
+	}
+	lockout := user.lockout
+	lockout.FailedAttempts = 0
+	return store.saveLockout(user, lockout)
+}
+
+// Clears the failed attempts, lockouts and any lock, done by an admin through Unlock
+func (store *store) clearLockout(user *User) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if user.lockout == (auth.Lockout{}) {
+		return nil
+	}
+	return store.saveLockout(user, auth.Lockout{})
+}
+
+// The caller must hold the lock
+func (store *store) saveLockout(user *User, lockout auth.Lockout) error {
+	user.lockout = lockout
+	return nil
+}
+
+func (store *store) enrollTOTP(user *User, secret string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	user.totpPending = secret
+	return nil
+}
+
+// Swaps the pending secret in once the code proves the authenticator app has it
+func (store *store) confirmTOTP(user *User, code string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if user.totpPending == "" {
+		return constants.ErrNotFound
+	}
+	counter, ok := totp.Validate(user.totpPending, code, time.Now(), store.options.totpSkew)
+	if !ok {
+		return constants.ErrInvalidCode
+	}
+	user.totpSecret = user.totpPending
+	user.totpPending = ""
+	user.totpCounter = counter
+	return nil
+}
+
+func (store *store) disableTOTP(user *User) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	user.totpSecret = ""
+	user.totpPending = ""
+	user.totpCounter = 0
+	return nil
+}
+
+// Accepts each code once, wrong codes count as failed logins
+func (store *store) verifyTOTP(user *User, code string) error {
+	store.lock.Lock()
+	if user.totpSecret == "" {
+		store.lock.Unlock()
+		return constants.ErrNotFound
+	}
+	if user.lockout.Locked() {
+		store.lock.Unlock()
+		return constants.ErrAccountLocked
+	}
+	counter, ok := totp.Validate(user.totpSecret, code, time.Now(), store.options.totpSkew)
+	if !ok || counter <= user.totpCounter {
+		store.lock.Unlock()
+		err := store.loginFailed(user)
+		if err != nil {
+			return err
+		}
+		return constants.ErrInvalidCode
+	}
+	user.totpCounter = counter
+	store.lock.Unlock()
+	return store.resetFailures(user)
+}
+
+func (store *store) setRecoveryCodes(user *User, hashes []string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	user.recoveryCodes = hashes
+	return nil
+}
+
+// Removes the code from the unused ones, wrong codes count as failed logins
+func (store *store) useRecoveryCode(user *User, code string) error {
+	hash := tokens.Hash(tokens.NormalizeReadable(code))
+	store.lock.Lock()
+	if user.lockout.Locked() {
+		store.lock.Unlock()
+		return constants.ErrAccountLocked
+	}
+	for index, unused := range user.recoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(unused), []byte(hash)) != 1 {
+			continue
+		}
+		user.recoveryCodes = append(user.recoveryCodes[:index:index], user.recoveryCodes[index+1:]...)
+		store.lock.Unlock()
+		return store.resetFailures(user)
+	}
+	store.lock.Unlock()
+	err := store.loginFailed(user)
+	if err != nil {
+		return err
+	}
+	return constants.ErrInvalidCode
+}
+
+func (store *store) setEmail(user *User, email string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, other := range store.users {
+		if other != user.account && email != "" && strings.EqualFold(other.email, email) {
+			return constants.ErrAlreadyExists
+		}
+	}
+	user.email = email
+	user.emailVerified = false
+	user.emailChanged = time.Now()
+	store.dropResets(user.username)
+	store.dropMagicLinks(user.username)
+	return nil
+}
+
+// Returns the username, address and time it was set that a verification token carries, nil without an address
+func (store *store) verificationClaims(user *User) []string {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if user.email == "" {
+		return nil
+	}
+	return []string{user.username, user.email, strconv.FormatInt(user.emailChanged.UnixNano(), 10)}
+}
+
+// Marks the email as verified once, if it is still the address the token was made for
+func (store *store) verifyEmail(user *User, email, changed string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if user.emailVerified || user.email != email || strconv.FormatInt(user.emailChanged.UnixNano(), 10) != changed {
+		return constants.ErrInvalidToken
+	}
+	user.emailVerified = true
+	return nil
+}
+
+// Mails a token, as a link below the configured base URL when there is one
+func (store *store) send(to, subject, text, path, token string) error {
+	if store.options.mailer == nil {
+		return constants.ErrNoMailer
+	}
+	body := text + ": " + token
+	if link := store.link(path, token); link != "" {
+		body = text + ": " + link
+	}
+	return store.options.mailer.Send(mailer.Message{To: to, Subject: subject, Body: body})
+}
+
+// Builds the link for a token below the configured base URL, empty without one
+func (store *store) link(path, token string) string {
+	if store.options.linkBase == "" {
+		return ""
+	}
+	return store.options.linkBase + path + "?token=" + url.QueryEscape(token)
+}
+
+// Hands the notification to the notifier, falling back to mailing it
+func (store *store) notify(notification notifier.Notification) error {
+	userNotifier := store.options.notifier
+	if userNotifier == nil {
+		if store.options.mailer == nil {
+			return constants.ErrNoMailer
+		}
+		userNotifier = notifier.Mail(store.options.mailer)
+	}
+	return userNotifier.Notify(notification)
+}
+
+// Finds a user by username or, case-insensitively, email address
+func (store *store) find(login string) (*User, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if user, ok := store.users[login]; ok {
+		return &User{account: user}, nil
+	}
+	for _, user := range store.users {
+		if user.email != "" && strings.EqualFold(user.email, login) {
+			return &User{account: user}, nil
+		}
+	}
+	return nil, constants.ErrNotFound
+}
+
+// Stores the hash of a reset token, replacing earlier ones of the user and dropping expired ones
+func (store *store) addReset(user *User, token string, expires time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	now := time.Now()
+	hash := tokens.Hash(token)
+	for existing, reset := range store.resets {
+		if reset.username == user.username || now.After(reset.expires) {
+			delete(store.resets, existing)
+		}
+	}
+	store.resets[hash] = &reset{username: user.username, expires: expires}
+	return nil
+}
+
+// Returns the user a live reset token belongs to without using it up
+func (store *store) findReset(token string) (*User, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	reset, ok := store.resets[tokens.Hash(token)]
+	if !ok || time.Now().After(reset.expires) {
+		return nil, constants.ErrInvalidToken
+	}
+	user, ok := store.users[reset.username]
+	if !ok {
+		return nil, constants.ErrInvalidToken
+	}
+	return &User{account: user}, nil
+}
+
+// Drops the user's reset tokens once the account or the address they were mailed to is gone, the caller must hold the lock
+func (store *store) dropResets(username string) {
+	for hash, reset := range store.resets {
+		if reset.username == username {
+			delete(store.resets, hash)
+		}
+	}
+}
+
+// Uses up a reset token, fails if it was used in the meantime
+func (store *store) takeReset(token string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	hash := tokens.Hash(token)
+	if _, ok := store.resets[hash]; !ok {
+		return constants.ErrInvalidToken
+	}
+	delete(store.resets, hash)
+	return nil
+}
+
+// Replaces an outdated password hash after a successful login, a failure only postpones the upgrade
+func (store *store) rehash(user *User, password string) {
+	passHash, err := store.options.hasher.Hash(password)
+	if err == nil {
+		err = store.replaceHash(user, passHash)
+	}
+	if err != nil {
+		store.options.logger.Println("rehash(): " + err.Error())
+	}
 }
 
-func (store *store) newSession(session string, user *User) error {
+// Issues a new session token for the user, respecting MaxSessions and RequireVerifiedEmail, service accounts get none
+func (store *store) openSession(user *User, client auth.Client, pendingMFA bool) error {
+	if user.serviceAccount {
+		return constants.ErrNotAllowed
+	}
+	if store.options.UserSettings.RequireVerifiedEmail && !user.EmailVerified() {
+		return constants.ErrEmailNotVerified
+	}
+	if store.options.UserSettings.MaxSessions == len(user.getSessions()) && store.options.UserSettings.MaxSessions > 0 {
+		return constants.ErrAlreadyAuthenticated
+	}
+	token, err := tokens.Generate(store.options.sessionTokenPrefix, store.options.sessionTokenLength)
+	if err != nil {
+		return err
+	}
+	user.session = token
+	return store.newSession(user.session, user, client, pendingMFA)
+}
+
+func (store *store) newSession(token string, user *User, client auth.Client, pendingMFA bool) error {
 	store.lock.Lock()
 	defer store.lock.Unlock()
-	if _, ok := store.sessions[session]; ok {
+	sessionID := tokens.Hash(token)
+	if _, ok := store.sessions[sessionID]; ok {
 		return constants.ErrAlreadyAuthenticated
 	}
-	store.sessions[session] = user
+	now := time.Now()
+	store.sessions[sessionID] = &session{user: user.account, created: now, lastSeen: now, client: client, pendingMFA: pendingMFA}
 	return nil
 }
+
+// Looks up a session by token, drops it if it has expired and marks it as seen otherwise
+func (store *store) lookupSession(token string) (*session, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	sessionID := tokens.Hash(token)
+	session, ok := store.sessions[sessionID]
+	if !ok {
+		return nil, constants.ErrNotFound
+	}
+	now := time.Now()
+	if store.expired(session, now) {
+		delete(store.sessions, sessionID)
+		return nil, constants.ErrSessionExpired
+	}
+	session.lastSeen = now
+	return session, nil
+}
+
+func (store *store) pendingMFA(session *session) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return session.pendingMFA
+}
+
+// Lifts the second factor restriction of a session, a no-op for full sessions
+func (store *store) completeMFA(token string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	sessionID := tokens.Hash(token)
+	session, ok := store.sessions[sessionID]
+	if !ok {
+		return constants.ErrNotFound
+	}
+	if !session.pendingMFA {
+		return nil
+	}
+	session.pendingMFA = false
+	return nil
+}
+
+// Removes sessions by their hashed id
+func (store *store) removeSessions(sessions []string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, session := range sessions {
+		delete(store.sessions, session)
+	}
+	return nil
+}
+
+// Returns the ids of the user's live sessions, the caller must hold the lock
+func (store *store) userSessions(user *User) []string {
+	var sessions []string
+	now := time.Now()
+	for sessionID, session := range store.sessions {
+		if session.user.username == user.username && !store.expired(session, now) {
+			sessions = append(sessions, sessionID)
+		}
+	}
+	return sessions
+}
+
+// Lists the user's live sessions with their metadata
+func (store *store) sessionInfo(user *User) []auth.Session {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var sessions []auth.Session
+	for _, sessionID := range store.userSessions(user) {
+		session := store.sessions[sessionID]
+		sessions = append(sessions, auth.Session{
+			ID:       sessionID,
+			Created:  session.created,
+			LastSeen: session.lastSeen,
+			Client:   session.client,
+			Current:  sessionID == tokens.Hash(user.session),
+		})
+	}
+	return sessions
+}
+
+func (store *store) expired(session *session, now time.Time) bool {
+	settings := store.options.UserSettings
+	return utils.SessionExpired(now, session.created, session.lastSeen, settings.SessionLifetime, settings.SessionIdleTimeout)
+}
+
+// Purges every expired session, run periodically by the reaper
+func (store *store) reap() {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	now := time.Now()
+	for sessionID, session := range store.sessions {
+		if store.expired(session, now) {
+			delete(store.sessions, sessionID)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package memory
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"github.com/Varppi/goauthy/internal/tokens"
+	"github.com/Varppi/goauthy/pkg/auth"
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/detector"
+	"github.com/Varppi/goauthy/pkg/notifier"
+)
+
+type magicLink struct {
+	username string
+	nonce    string // hash of the browser nonce, empty if the link works in any browser
+	expires  time.Time
+}
+
+/*
+Sends a single-use login link to the user with that username or email address through the notifier,
+only users with a verified email address get one
+With bindToBrowser a nonce is returned that has to come back with the token, e.g. kept in a cookie,
+so a link opened in another browser is useless. Unknown logins and unverified users get a nonce and nil as well
+RequestMagicLink(login, bindToBrowser)
+*/
+func (store *store) RequestMagicLink(login string, bindToBrowser bool) (string, error) {
+	var nonce, nonceHash string
+	if bindToBrowser {
+		var err error
+		nonce, err = tokens.Generate("gan", tokens.MinLength)
+		if err != nil {
+			return "", err
+		}
+		nonceHash = tokens.Hash(nonce)
+	}
+	user, err := store.find(login)
+	if err != nil || !user.EmailVerified() {
+		return nonce, nil
+	}
+	ttl := store.options.UserSettings.MagicLinkTTL
+	if ttl == 0 {
+		ttl = 15 * time.Minute
+	}
+	token, err := tokens.Generate("gml", store.options.sessionTokenLength)
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(ttl)
+	err = store.addMagicLink(token, &magicLink{username: user.username, nonce: nonceHash, expires: expires})
+	if err != nil {
+		return "", err
+	}
+	err = store.notify(notifier.Notification{
+		Kind:     notifier.MagicLink,
+		Username: user.username,
+		Email:    user.Email(),
+		Token:    token,
+		Link:     store.link("/magic-login", token),
+		Expires:  expires,
+	})
+	if err != nil {
+		return "", err
+	}
+	return nonce, nil
+}
+
+/*
+Exchanges a token from RequestMagicLink for a session, nonce is the value RequestMagicLink returned or empty
+The link stands in for the password only, a user with TOTP gets ErrMFARequired like from Login
+LoginWithMagicLink(token, nonce, auth.Client{IP, UserAgent, Device})
+*/
+func (store *store) LoginWithMagicLink(token, nonce string, client auth.Client) (auth.User, error) {
+	switch store.options.detector.Check(client.IP) {
+	case detector.Block:
+		return &User{account: &account{}}, constants.ErrSourceBlocked
+	case detector.Challenge:
+		if !client.ChallengeSolved {
+			return &User{account: &account{}}, constants.ErrChallengeRequired
+		}
+	}
+	link, err := store.takeMagicLink(token)
+	if err != nil {
+		// Every guessed token counts as an account of its own so guessing escalates like spraying passwords
+		store.options.detector.Failure(client.IP, "magic-link:"+tokens.Hash(token))
+		return &User{account: &account{}}, err
+	}
+	if link.nonce != "" && subtle.ConstantTimeCompare([]byte(link.nonce), []byte(tokens.Hash(nonce))) != 1 {
+		store.options.detector.Failure(client.IP, link.username)
+		return &User{account: &account{}}, constants.ErrInvalidToken
+	}
+	user, err := store.get(link.username)
+	if err != nil {
+		return &User{account: &account{}}, constants.ErrInvalidToken
+	}
+	if store.locked(user) {
+		return &User{account: &account{}}, constants.ErrAccountLocked
+	}
+	pendingMFA := user.TOTPEnabled()
+	err = store.openSession(user, client, pendingMFA)
+	if err != nil {
+		return &User{account: &account{}}, err
+	}
+	if pendingMFA {
+		return user, constants.ErrMFARequired
+	}
+	if user.PasswordChangeRequired() {
+		return user, constants.ErrPasswordChangeRequired
+	}
+	return user, nil
+}
+
+// Stores the hash of a login link token, replacing earlier ones of the user and dropping expired ones
+func (store *store) addMagicLink(token string, link *magicLink) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	now := time.Now()
+	hash := tokens.Hash(token)
+	for existing, other := range store.magicLinks {
+		if other.username == link.username || now.After(other.expires) {
+			delete(store.magicLinks, existing)
+		}
+	}
+	store.magicLinks[hash] = link
+	return nil
+}
+
+// Drops the user's login links once the account or the address they were mailed to is gone, the caller must hold the lock
+func (store *store) dropMagicLinks(username string) {
+	for hash, link := range store.magicLinks {
+		if link.username == username {
+			delete(store.magicLinks, hash)
+		}
+	}
+}
+
+// Uses up a login link token, whether or not the rest of the login succeeds
+func (store *store) takeMagicLink(token string) (*magicLink, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	hash := tokens.Hash(token)
+	link, ok := store.magicLinks[hash]
+	if !ok {
+		return nil, constants.ErrInvalidToken
+	}
+	delete(store.magicLinks, hash)
+	if time.Now().After(link.expires) {
+		return nil, constants.ErrInvalidToken
+	}
+	return link, nil
+}
@@ -0,0 +1,244 @@
+package memory
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/Varppi/goauthy/internal/tokens"
+	"github.com/Varppi/goauthy/internal/utils"
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/detector"
+	"github.com/Varppi/goauthy/pkg/hasher"
+	"github.com/Varppi/goauthy/pkg/mailer"
+	"github.com/Varppi/goauthy/pkg/notifier"
+	"github.com/Varppi/goauthy/pkg/policy"
+	"github.com/Varppi/goauthy/pkg/webauthn"
+)
+
+// Configures the store, passed to Init
+type Option func(options *Options) error
+
+func defaultOptions() *Options {
+	return &Options{
+		logger:        log.Default(),
+		UserSettings:  &UserSettings{MaxSessions: 0, AllowPasswordChange: true},
+		usernameRegex: regexp.MustCompile(`^[a-zA-Z0-9+\.+_]+$`),
+		passRegex:     regexp.MustCompile(`.+`),
+
+		sessionTokenPrefix: "gas",
+		sessionTokenLength: 32,
+		hasher:             hasher.NewBcrypt(10),
+		totpIssuer:         "goauthy",
+		totpSkew:           1,
+		recoveryCodes:      10,
+	}
+}
+
+// Sets the logger used for store errors  default:log.Default()
+func WithLogger(logger *log.Logger) Option {
+	return func(options *Options) error {
+		if logger == nil {
+			return fmt.Errorf("WithLogger(): %w: logger is nil", constants.ErrInvalidOption)
+		}
+		options.logger = logger
+		return nil
+	}
+}
+
+// Sets the user settings  default:&UserSettings{MaxSessions: 0, AllowPasswordChange: true}
+func WithUserSettings(settings *UserSettings) Option {
+	return func(options *Options) error {
+		if settings == nil {
+			return fmt.Errorf("WithUserSettings(): %w: settings is nil", constants.ErrInvalidOption)
+		}
+		if settings.MaxSessions < 0 {
+			return fmt.Errorf("WithUserSettings(): %w: MaxSessions must be 0 or greater", constants.ErrInvalidOption)
+		}
+		if settings.LockoutThreshold < 0 || settings.LockoutThreshold > 0 && settings.LockoutDuration <= 0 {
+			return fmt.Errorf("WithUserSettings(): %w: LockoutThreshold needs a positive LockoutDuration", constants.ErrInvalidOption)
+		}
+		if settings.PasswordHistory < 0 {
+			return fmt.Errorf("WithUserSettings(): %w: PasswordHistory must be 0 or greater", constants.ErrInvalidOption)
+		}
+		if settings.SessionLifetime < 0 || settings.SessionIdleTimeout < 0 || settings.ReapInterval < 0 || settings.PasswordMaxAge < 0 || settings.LockoutMaxDuration < 0 {
+			return fmt.Errorf("WithUserSettings(): %w: durations must be 0 or greater", constants.ErrInvalidOption)
+		}
+		options.UserSettings = settings
+		return nil
+	}
+}
+
+// Sets the regex usernames must match  default:^[a-zA-Z0-9+\.+_]+$
+func WithUsernamePattern(pattern string) Option {
+	return func(options *Options) error {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("WithUsernamePattern(): %w: %w", constants.ErrInvalidOption, err)
+		}
+		options.usernameRegex = regex
+		return nil
+	}
+}
+
+// Sets the regex passwords must match  default:.+
+func WithPasswordPattern(pattern string) Option {
+	return func(options *Options) error {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("WithPasswordPattern(): %w: %w", constants.ErrInvalidOption, err)
+		}
+		options.passRegex = regex
+		return nil
+	}
+}
+
+// Sets the prefix and random length of session tokens  default:gas, 32
+func WithSessionTokens(prefix string, length int) Option {
+	return func(options *Options) error {
+		if !regexp.MustCompile(`^[a-zA-Z0-9]+$`).MatchString(prefix) {
+			return fmt.Errorf("WithSessionTokens(): %w: prefix must be alphanumeric", constants.ErrInvalidOption)
+		}
+		if length < tokens.MinLength {
+			return fmt.Errorf("WithSessionTokens(): %w: length must be at least %d", constants.ErrInvalidOption, tokens.MinLength)
+		}
+		options.sessionTokenPrefix = prefix
+		options.sessionTokenLength = length
+		return nil
+	}
+}
+
+/*
+Sets the hasher new passwords are hashed with  default:hasher.NewBcrypt(10)
+Existing hashes of any other algorithm or parameters keep working and are rehashed on the next login
+*/
+func WithPasswordHasher(passwordHasher hasher.PasswordHasher) Option {
+	return func(options *Options) error {
+		if passwordHasher == nil {
+			return fmt.Errorf("WithPasswordHasher(): %w: hasher is nil", constants.ErrInvalidOption)
+		}
+		err := hasher.Validate(passwordHasher)
+		if err != nil {
+			return fmt.Errorf("WithPasswordHasher(): %w: %w", constants.ErrInvalidOption, err)
+		}
+		options.hasher = passwordHasher
+		return nil
+	}
+}
+
+// Sets the policy passwords are checked against in Add and ChangePassword, on top of the password pattern  default:none
+func WithPasswordPolicy(passwordPolicy *policy.PasswordPolicy) Option {
+	return func(options *Options) error {
+		if passwordPolicy == nil {
+			return fmt.Errorf("WithPasswordPolicy(): %w: policy is nil", constants.ErrInvalidOption)
+		}
+		options.policy = passwordPolicy
+		return nil
+	}
+}
+
+/*
+Sets the detector that watches failed logins per client IP across accounts  default:none
+Blocked sources get constants.ErrSourceBlocked, challenged ones constants.ErrChallengeRequired until auth.Client.ChallengeSolved is set
+*/
+func WithDetector(loginDetector *detector.Detector) Option {
+	return func(options *Options) error {
+		if loginDetector == nil {
+			return fmt.Errorf("WithDetector(): %w: detector is nil", constants.ErrInvalidOption)
+		}
+		options.detector = loginDetector
+		return nil
+	}
+}
+
+// Sets the issuer shown in authenticator apps and how many 30 second steps codes may drift  default:goauthy, 1
+func WithTOTP(issuer string, skew int) Option {
+	return func(options *Options) error {
+		if issuer == "" || strings.Contains(issuer, ":") {
+			return fmt.Errorf("WithTOTP(): %w: issuer must be non-empty and must not contain a colon", constants.ErrInvalidOption)
+		}
+		if skew < 0 {
+			return fmt.Errorf("WithTOTP(): %w: skew must be 0 or greater", constants.ErrInvalidOption)
+		}
+		options.totpIssuer = issuer
+		options.totpSkew = skew
+		return nil
+	}
+}
+
+// Sets how many recovery codes GenerateRecoveryCodes hands out  default:10
+func WithRecoveryCodes(count int) Option {
+	return func(options *Options) error {
+		if count < 1 {
+			return fmt.Errorf("WithRecoveryCodes(): %w: count must be at least 1", constants.ErrInvalidOption)
+		}
+		options.recoveryCodes = count
+		return nil
+	}
+}
+
+// Enables passkeys for the relying party  default:disabled
+func WithWebAuthn(relyingParty *webauthn.RelyingParty) Option {
+	return func(options *Options) error {
+		if relyingParty == nil || relyingParty.ID == "" || len(relyingParty.Origins) == 0 {
+			return fmt.Errorf("WithWebAuthn(): %w: relying party needs an ID and at least one origin", constants.ErrInvalidOption)
+		}
+		options.relyingParty = relyingParty
+		return nil
+	}
+}
+
+/*
+Sets the mailer used to reach users and the base URL links in messages point to, e.g. https://example.com/auth
+The token is appended as ?token= to paths like /verify-email, without a base URL messages carry the bare token  default:none
+*/
+func WithMailer(userMailer mailer.Mailer, linkBase string) Option {
+	return func(options *Options) error {
+		if userMailer == nil {
+			return fmt.Errorf("WithMailer(): %w: mailer is nil", constants.ErrInvalidOption)
+		}
+		options.mailer = userMailer
+		options.linkBase = strings.TrimRight(linkBase, "/")
+		return nil
+	}
+}
+
+// Sets the key tokens like email verification links are signed with, at least 32 bytes  default:random per process
+func WithSigningKey(key []byte) Option {
+	return func(options *Options) error {
+		if len(key) < 32 {
+			return fmt.Errorf("WithSigningKey(): %w: key must be at least 32 bytes", constants.ErrInvalidOption)
+		}
+		options.signingKey = key
+		return nil
+	}
+}
+
+// Sets how password reset and login tokens reach users  default:notifier.Mail of the WithMailer mailer
+func WithNotifier(userNotifier notifier.Notifier) Option {
+	return func(options *Options) error {
+		if userNotifier == nil {
+			return fmt.Errorf("WithNotifier(): %w: notifier is nil", constants.ErrInvalidOption)
+		}
+		options.notifier = userNotifier
+		return nil
+	}
+}
+
+// Restricts personal access tokens to a known set of scopes like "read:profile"  default:any well-formed scope
+func WithScopes(scopes ...string) Option {
+	return func(options *Options) error {
+		if len(scopes) == 0 {
+			return fmt.Errorf("WithScopes(): %w: no scopes given", constants.ErrInvalidOption)
+		}
+		options.scopes = make(map[string]bool)
+		for _, scope := range scopes {
+			if !utils.ValidScope(scope) {
+				return fmt.Errorf("WithScopes(): %w: malformed scope %q", constants.ErrInvalidOption, scope)
+			}
+			options.scopes[scope] = true
+		}
+		return nil
+	}
+}
@@ -0,0 +1,303 @@
+package memory
+
+import (
+	"crypto/sha256"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/auth"
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/detector"
+	"github.com/Varppi/goauthy/pkg/webauthn"
+)
+
+type passkey struct {
+	credential webauthn.Credential
+	name       string
+	created    time.Time
+	lastUsed   time.Time
+}
+
+// Most ceremonies that may be pending at once, further ones are refused until expired ones are dropped
+const maxChallenges = 10000
+
+// A started passkey ceremony, challenges are single use and only kept in memory
+type challenge struct {
+	username     string // empty for logins with a discoverable passkey
+	registration bool
+	expires      time.Time
+}
+
+// Starts registering a passkey, pass the options to navigator.credentials.create
+func (user *User) BeginPasskeyRegistration() (webauthn.CreationOptions, error) {
+	relyingParty := user.store.options.relyingParty
+	if relyingParty == nil {
+		return webauthn.CreationOptions{}, constants.ErrPasskeysDisabled
+	}
+	if !user.validateSession() {
+		return webauthn.CreationOptions{}, constants.ErrNotAllowed
+	}
+	challenge, err := user.store.newChallenge(user.username, true)
+	if err != nil {
+		return webauthn.CreationOptions{}, err
+	}
+	userID := sha256.Sum256([]byte(user.username))
+	return relyingParty.CreationOptions(challenge, userID[:], user.username, user.store.passkeyIDs(user)), nil
+}
+
+// Verifies the authenticator's response to BeginPasskeyRegistration and stores the passkey under name
+func (user *User) FinishPasskeyRegistration(name string, response webauthn.RegistrationResponse) error {
+	relyingParty := user.store.options.relyingParty
+	if relyingParty == nil {
+		return constants.ErrPasskeysDisabled
+	}
+	if !user.validateSession() {
+		return constants.ErrNotAllowed
+	}
+	challenge, err := response.Challenge()
+	if err != nil {
+		return err
+	}
+	pending, err := user.store.takeChallenge(challenge, true)
+	if err != nil {
+		return err
+	}
+	if pending.username != user.username {
+		return constants.ErrInvalidChallenge
+	}
+	credential, err := relyingParty.VerifyRegistration(response, challenge)
+	if err != nil {
+		return err
+	}
+	return user.store.addPasskey(user, &passkey{credential: credential, name: name, created: time.Now()})
+}
+
+// Lists the user's passkeys
+func (user *User) Passkeys() ([]auth.Passkey, error) {
+	if !user.validateSession() {
+		return nil, constants.ErrNotAllowed
+	}
+	user.store.lock.Lock()
+	defer user.store.lock.Unlock()
+	var passkeys []auth.Passkey
+	for _, passkey := range user.passkeys {
+		passkeys = append(passkeys, auth.Passkey{
+			ID:          passkey.credential.ID,
+			Name:        passkey.name,
+			Attestation: passkey.credential.Attestation,
+			Created:     passkey.created,
+			LastUsed:    passkey.lastUsed,
+		})
+	}
+	return passkeys, nil
+}
+
+// Removes one of the user's passkeys, takes the ID listed by Passkeys
+func (user *User) RemovePasskey(id string) error {
+	if !user.validateSession() {
+		return constants.ErrNotAllowed
+	}
+	return user.store.removePasskey(user, id)
+}
+
+/*
+Starts a passkey login, pass the options to navigator.credentials.get
+An empty username lets the user pick any discoverable passkey registered for the site
+*/
+func (store *store) BeginPasskeyLogin(username string) (webauthn.RequestOptions, error) {
+	relyingParty := store.options.relyingParty
+	if relyingParty == nil {
+		return webauthn.RequestOptions{}, constants.ErrPasskeysDisabled
+	}
+	var allow []string
+	if username != "" {
+		user, err := store.get(username)
+		if err != nil {
+			return webauthn.RequestOptions{}, err
+		}
+		allow = store.passkeyIDs(user)
+	}
+	challenge, err := store.newChallenge(username, false)
+	if err != nil {
+		return webauthn.RequestOptions{}, err
+	}
+	return relyingParty.RequestOptions(challenge, allow), nil
+}
+
+/*
+Verifies the authenticator's response to BeginPasskeyLogin and returns the user with a new session
+A passkey that verified the user with a PIN or biometric counts as two factors, without user verification
+a user with TOTP gets ErrMFARequired like from Login. Failed assertions count as failed logins
+FinishPasskeyLogin(response, auth.Client{IP, UserAgent, Device})
+*/
+func (store *store) FinishPasskeyLogin(response webauthn.AssertionResponse, client auth.Client) (auth.User, error) {
+	relyingParty := store.options.relyingParty
+	if relyingParty == nil {
+		return &User{account: &account{}}, constants.ErrPasskeysDisabled
+	}
+	switch store.options.detector.Check(client.IP) {
+	case detector.Block:
+		return &User{account: &account{}}, constants.ErrSourceBlocked
+	case detector.Challenge:
+		if !client.ChallengeSolved {
+			return &User{account: &account{}}, constants.ErrChallengeRequired
+		}
+	}
+	challenge, err := response.Challenge()
+	if err != nil {
+		return &User{account: &account{}}, err
+	}
+	pending, err := store.takeChallenge(challenge, false)
+	if err != nil {
+		return &User{account: &account{}}, err
+	}
+	owner, passkey := store.findPasskey(response.ID)
+	if owner == nil || pending.username != "" && pending.username != owner.username {
+		store.options.detector.Failure(client.IP, pending.username)
+		return &User{account: &account{}}, constants.ErrInvalidCredentials
+	}
+	user := &User{account: owner}
+	if store.locked(user) {
+		return &User{account: &account{}}, constants.ErrAccountLocked
+	}
+	store.lock.Lock()
+	credential := passkey.credential
+	store.lock.Unlock()
+	assertion, err := relyingParty.VerifyAssertion(response, challenge, credential)
+	if err != nil {
+		store.options.detector.Failure(client.IP, user.username)
+		failErr := store.loginFailed(user)
+		if failErr != nil {
+			store.options.logger.Println("FinishPasskeyLogin(): " + failErr.Error())
+		}
+		return &User{account: &account{}}, err
+	}
+	err = store.usePasskey(user, passkey, assertion.SignCount)
+	if err != nil {
+		return &User{account: &account{}}, err
+	}
+	pendingMFA := !assertion.UserVerified && user.TOTPEnabled()
+	if !pendingMFA {
+		err = store.resetFailures(user)
+		if err != nil {
+			return &User{account: &account{}}, err
+		}
+	}
+	err = store.openSession(user, client, pendingMFA)
+	if err != nil {
+		return &User{account: &account{}}, err
+	}
+	if pendingMFA {
+		return user, constants.ErrMFARequired
+	}
+	if user.PasswordChangeRequired() {
+		return user, constants.ErrPasswordChangeRequired
+	}
+	return user, nil
+}
+
+func (store *store) newChallenge(username string, registration bool) (string, error) {
+	key, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	now := time.Now()
+	timeout := store.options.relyingParty.ChallengeTimeout()
+	// Sweeping once per timeout keeps a flood of ceremonies from making every call walk the map
+	if now.After(store.challengeSweep) {
+		for key, pending := range store.challenges {
+			if now.After(pending.expires) {
+				delete(store.challenges, key)
+			}
+		}
+		store.challengeSweep = now.Add(timeout)
+	}
+	if len(store.challenges) >= maxChallenges {
+		return "", constants.ErrTooManyChallenges
+	}
+	store.challenges[key] = &challenge{
+		username:     username,
+		registration: registration,
+		expires:      now.Add(timeout),
+	}
+	return key, nil
+}
+
+// Removes the challenge so it can only be answered once
+func (store *store) takeChallenge(key string, registration bool) (*challenge, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	pending, ok := store.challenges[key]
+	if !ok {
+		return nil, constants.ErrInvalidChallenge
+	}
+	delete(store.challenges, key)
+	if pending.registration != registration || time.Now().After(pending.expires) {
+		return nil, constants.ErrInvalidChallenge
+	}
+	return pending, nil
+}
+
+func (store *store) passkeyIDs(user *User) []string {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var ids []string
+	for _, passkey := range user.passkeys {
+		ids = append(ids, passkey.credential.ID)
+	}
+	return ids
+}
+
+func (store *store) findPasskey(id string) (*account, *passkey) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, user := range store.users {
+		for _, passkey := range user.passkeys {
+			if passkey.credential.ID == id {
+				return user, passkey
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (store *store) addPasskey(user *User, passkey *passkey) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, other := range store.users {
+		for _, existing := range other.passkeys {
+			if existing.credential.ID == passkey.credential.ID {
+				return constants.ErrAlreadyExists
+			}
+		}
+	}
+	user.passkeys = append(user.passkeys, passkey)
+	return nil
+}
+
+func (store *store) removePasskey(user *User, id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for index, passkey := range user.passkeys {
+		if passkey.credential.ID != id {
+			continue
+		}
+		user.passkeys = append(user.passkeys[:index:index], user.passkeys[index+1:]...)
+		return nil
+	}
+	return constants.ErrNotFound
+}
+
+// Stores the new signature counter, compared again under the lock so concurrent assertions cannot move it backwards
+func (store *store) usePasskey(user *User, passkey *passkey, signCount uint32) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if (signCount != 0 || passkey.credential.SignCount != 0) && signCount <= passkey.credential.SignCount {
+		return webauthn.ErrCounterRegressed
+	}
+	now := time.Now()
+	passkey.credential.SignCount = signCount
+	passkey.lastUsed = now
+	return nil
+}
@@ -0,0 +1,64 @@
+package notifier
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/mailer"
+)
+
+type Kind string
+
+const (
+	PasswordReset Kind = "password-reset"
+	MagicLink     Kind = "magic-link"
+)
+
+var ErrNoAddress = errors.New("the user has no email address")
+
+// A secret the store hands to a user out of band
+type Notification struct {
+	Kind     Kind
+	Username string
+	Email    string // empty if the user has none
+	Token    string
+	Link     string // token appended to the store's link base, empty without one
+	Expires  time.Time
+}
+
+// Delivers notifications to users, e.g. by email, SMS or a chat message
+type Notifier interface {
+	Notify(notification Notification) error
+}
+
+// Adapts a plain function to Notifier
+type Func func(notification Notification) error
+
+func (notify Func) Notify(notification Notification) error {
+	return notify(notification)
+}
+
+var subjects = map[Kind]string{
+	PasswordReset: "Reset your password",
+	MagicLink:     "Your login link",
+}
+
+var texts = map[Kind]string{
+	PasswordReset: "Use this to choose a new password",
+	MagicLink:     "Use this to log in",
+}
+
+// Delivers notifications as email through the mailer, users without an address get ErrNoAddress
+func Mail(userMailer mailer.Mailer) Notifier {
+	return Func(func(notification Notification) error {
+		if notification.Email == "" {
+			return ErrNoAddress
+		}
+		secret := notification.Link
+		if secret == "" {
+			secret = notification.Token
+		}
+		body := texts[notification.Kind] + " before " + notification.Expires.UTC().Format(time.RFC1123) + ": " + secret
+		return userMailer.Send(mailer.Message{To: notification.Email, Subject: subjects[notification.Kind], Body: body})
+	})
+}
@@ -0,0 +1,105 @@
+package persistent
+
+import (
+	"slices"
+	"time"
+
+	"github.com/Varppi/goauthy/internal/tokens"
+	"github.com/Varppi/goauthy/internal/utils"
+	"github.com/Varppi/goauthy/pkg/auth"
+	"github.com/Varppi/goauthy/pkg/constants"
+)
+
+/*
+Creates a personal access token that acts as the user, limited to the given scopes and the user's access level
+Only its hash is stored so this is the one chance to show it, a zero expires means the token never expires
+CreatePersonalToken(name, []string{"read:profile"}, expires)
+*/
+func (user *User) CreatePersonalToken(name string, scopes []string, expires time.Time) (string, error) {
+	if !user.validateSession() {
+		return "", constants.ErrNotAllowed
+	}
+	if len(scopes) == 0 {
+		return "", constants.ErrInvalidScope
+	}
+	for _, scope := range scopes {
+		if !utils.ValidScope(scope) || user.store.options.scopes != nil && !user.store.options.scopes[scope] {
+			return "", constants.ErrInvalidScope
+		}
+	}
+	if !expires.IsZero() && time.Now().After(expires) {
+		return "", constants.ErrNotAllowed
+	}
+	token, err := tokens.Generate(personalTokenPrefix, user.store.options.sessionTokenLength)
+	if err != nil {
+		return "", err
+	}
+	err = user.store.addAPIKey(user, &apiKey{
+		id:      tokens.Hash(token),
+		name:    name,
+		access:  user.access,
+		scopes:  slices.Clone(scopes),
+		created: time.Now(),
+		expires: expires,
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Lists the user's personal access tokens, expired ones included until they are revoked
+func (user *User) PersonalTokens() ([]auth.PersonalToken, error) {
+	if !user.validateSession() {
+		return nil, constants.ErrNotAllowed
+	}
+	user.store.lock.Lock()
+	defer user.store.lock.Unlock()
+	var personalTokens []auth.PersonalToken
+	for _, key := range user.apiKeys {
+		if len(key.scopes) == 0 {
+			continue
+		}
+		personalTokens = append(personalTokens, auth.PersonalToken{
+			ID:       key.id,
+			Name:     key.name,
+			Scopes:   slices.Clone(key.scopes),
+			Created:  key.created,
+			Expires:  key.expires,
+			LastUsed: key.lastUsed,
+		})
+	}
+	return personalTokens, nil
+}
+
+// Revokes one of the user's personal access tokens, takes the ID listed by PersonalTokens
+func (user *User) RevokePersonalToken(id string) error {
+	if !user.validateSession() {
+		return constants.ErrNotAllowed
+	}
+	return user.store.removeAPIKey(user, id, true, constants.ADMIN)
+}
+
+// Reports whether the scope was granted, sessions and API keys hold every scope, personal access tokens only their own
+func (user *User) HasScope(scope string) bool {
+	if user.validateSession() {
+		return true
+	}
+	key, ok := user.handleKey()
+	return ok && (len(key.scopes) == 0 || slices.Contains(key.scopes, scope))
+}
+
+/*
+Checks the access level like CheckAccess and the scope like HasScope, use it where personal access tokens are accepted
+CheckAccess refuses personal access tokens so a token never passes a check that does not name a scope
+*/
+func (user *User) CheckScopedAccess(accessLevel int, scope string) bool {
+	key, ok := user.handleKey()
+	if !ok || len(key.scopes) == 0 {
+		return user.CheckAccess(accessLevel) && user.HasScope(scope)
+	}
+	if user.access == constants.DELETED || !slices.Contains(key.scopes, scope) {
+		return false
+	}
+	return accessLevel == -1 || user.access <= accessLevel && key.access <= accessLevel
+}
@@ -0,0 +1,233 @@
+package persistent
+
+import (
+	"time"
+
+	"github.com/Varppi/goauthy/internal/tokens"
+	"github.com/Varppi/goauthy/pkg/auth"
+	"github.com/Varppi/goauthy/pkg/constants"
+)
+
+// Prefixes of API keys and personal access tokens, session tokens use the configurable one from WithSessionTokens
+const (
+	apiKeyPrefix        = "gak"
+	personalTokenPrefix = "gpt"
+)
+
+type apiKey struct {
+	id       string // sha256 of the key, the key itself is only returned by CreateAPIKey
+	name     string
+	access   int // ceiling, never more than the owner's access
+	created  time.Time
+	expires  time.Time // zero if the key never expires
+	lastUsed time.Time
+	stored   time.Time // lastUsed as last written to the database
+	scopes   []string  // set for personal access tokens only
+}
+
+/*
+Adds an account for batch jobs and CI that cannot log in and only authenticates with API keys
+AddServiceAccount(username, access level)
+*/
+func (store *store) AddServiceAccount(username string, access int) error {
+	if !store.options.usernameRegex.Match([]byte(username)) {
+		return constants.ErrInvalidUsernamePassword
+	}
+	user := &User{account: &account{
+		username:        username,
+		access:          access,
+		store:           store,
+		variables:       make(map[string]any),
+		passwordChanged: time.Now(),
+		serviceAccount:  true,
+	}}
+	err := store.insert(user)
+	if err != nil {
+		store.options.logger.Println("AddServiceAccount(): " + err.Error())
+	}
+	return err
+}
+
+// Reports whether the user is a service account without a password
+func (user *User) IsServiceAccount() bool {
+	return user.serviceAccount
+}
+
+/*
+Creates a long-lived key that works anywhere a session token does, only its hash is stored
+so this is the one chance to show it. access is the highest level CheckAccess grants through the key
+and may not exceed the owner's, a zero expires means the key never expires
+CreateAPIKey(name, access level, expires)
+*/
+func (user *User) CreateAPIKey(name string, access int, expires time.Time) (string, error) {
+	ceiling, ok := user.keyCeiling()
+	if !ok || access < ceiling || !expires.IsZero() && time.Now().After(expires) {
+		return "", constants.ErrNotAllowed
+	}
+	token, err := tokens.Generate(apiKeyPrefix, user.store.options.sessionTokenLength)
+	if err != nil {
+		return "", err
+	}
+	err = user.store.addAPIKey(user, &apiKey{id: tokens.Hash(token), name: name, access: access, created: time.Now(), expires: expires})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Lists the user's API keys the handle may manage, expired ones included until they are revoked
+func (user *User) APIKeys() ([]auth.APIKey, error) {
+	ceiling, ok := user.manageCeiling()
+	if !ok {
+		return nil, constants.ErrNotAllowed
+	}
+	user.store.lock.Lock()
+	defer user.store.lock.Unlock()
+	var keys []auth.APIKey
+	for _, key := range user.apiKeys {
+		if len(key.scopes) != 0 || key.access < ceiling {
+			continue
+		}
+		keys = append(keys, auth.APIKey{
+			ID:       key.id,
+			Name:     key.name,
+			Access:   key.access,
+			Created:  key.created,
+			Expires:  key.expires,
+			LastUsed: key.lastUsed,
+		})
+	}
+	return keys, nil
+}
+
+// Revokes one of the user's API keys, takes the ID listed by APIKeys
+func (user *User) RevokeAPIKey(id string) error {
+	ceiling, ok := user.manageCeiling()
+	if !ok {
+		return constants.ErrNotAllowed
+	}
+	return user.store.removeAPIKey(user, id, false, ceiling)
+}
+
+/*
+Returns the highest access the handle may create keys with and whether it may manage keys at all
+Users manage their keys from a full session, service accounts also through the handle an admin looked up
+or one of their own keys, which never reaches above its own ceiling and stops working once the key is revoked or expires
+*/
+func (user *User) keyCeiling() (int, bool) {
+	if user.ownsKeys() {
+		return user.access, true
+	}
+	keyAccess, ok := user.apiKeyAccess()
+	return max(keyAccess, user.access), ok && user.serviceAccount
+}
+
+// Returns the lowest access of the keys the handle may list and revoke, owners reach every key they hold
+func (user *User) manageCeiling() (int, bool) {
+	if user.ownsKeys() {
+		return constants.ADMIN, true
+	}
+	return user.keyCeiling()
+}
+
+// Reports whether the handle acts as the owner of the keys, from a full session or an admin lookup of a service account
+func (user *User) ownsKeys() bool {
+	return user.validateSession() || user.serviceAccount && user.lookup
+}
+
+// Returns the access ceiling of the API key the handle was obtained with, personal access tokens have none
+func (user *User) apiKeyAccess() (int, bool) {
+	key, ok := user.handleKey()
+	if !ok || len(key.scopes) != 0 {
+		return 0, false
+	}
+	return key.access, true
+}
+
+// Returns the API key or personal access token the handle was obtained with
+func (user *User) handleKey() (*apiKey, bool) {
+	owner, key, err := user.store.useAPIKey(user.session)
+	if err != nil || owner != user.account {
+		return nil, false
+	}
+	return key, true
+}
+
+// Finds the owner of an API key by its hash, the caller must hold the lock
+func (store *store) findAPIKey(id string) (*account, *apiKey) {
+	for _, user := range store.users {
+		for _, key := range user.apiKeys {
+			if key.id == id {
+				return user, key
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Looks up an API key by token, refusing expired ones and marking it as used otherwise, returns a copy that is safe to read without the lock
+func (store *store) useAPIKey(token string) (*account, *apiKey, error) {
+	// Session tokens and malformed input are turned away by the checksum before hashing and scanning every user's keys
+	if !tokens.Valid(token, apiKeyPrefix) && !tokens.Valid(token, personalTokenPrefix) {
+		return nil, nil, constants.ErrNotFound
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	user, key := store.findAPIKey(tokens.Hash(token))
+	if user == nil {
+		return nil, nil, constants.ErrNotFound
+	}
+	now := time.Now()
+	if !key.expires.IsZero() && now.After(key.expires) {
+		return nil, nil, constants.ErrSessionExpired
+	}
+	// Keys used in a loop would otherwise write on every request
+	if now.Sub(key.stored) >= time.Minute {
+		err := store.repository.touchAPIKey(key.id, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		key.stored = now
+	}
+	key.lastUsed = now
+	copied := *key
+	return user, &copied, nil
+}
+
+func (store *store) addAPIKey(user *User, key *apiKey) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	err := store.repository.insertAPIKey(user.username, key)
+	if err != nil {
+		return err
+	}
+	user.apiKeys = append(user.apiKeys, key)
+	return nil
+}
+
+// Removes an API key, or with personal set a personal access token, of the user if its access is within ceiling
+func (store *store) removeAPIKey(user *User, id string, personal bool, ceiling int) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for index, key := range user.apiKeys {
+		if key.id == id && personal == (len(key.scopes) != 0) && key.access >= ceiling {
+			err := store.repository.deleteAPIKey(user.username, id)
+			if err != nil {
+				return err
+			}
+			user.apiKeys = append(user.apiKeys[:index:index], user.apiKeys[index+1:]...)
+			return nil
+		}
+	}
+	return constants.ErrNotFound
+}
+
+func (store *store) rawAPIKey(username string, key *apiKey) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	user, ok := store.users[username]
+	if !ok {
+		return
+	}
+	user.apiKeys = append(user.apiKeys, key)
+}
@@ -1,20 +1,55 @@
 package persistent
 
 import (
-	"database/sql"
+	"crypto/subtle"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/Varppi/goauthy/internal/tokens"
 	"github.com/Varppi/goauthy/internal/utils"
+	"github.com/Varppi/goauthy/pkg/auth"
 	"github.com/Varppi/goauthy/pkg/constants"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/Varppi/goauthy/pkg/hasher"
+	"github.com/Varppi/goauthy/pkg/mailer"
+	"github.com/Varppi/goauthy/pkg/notifier"
+	"github.com/Varppi/goauthy/pkg/totp"
 )
 
+/*
+Sessions are keyed by the sha256 of their token, the token itself only lives in the user object
+handed out by Login so a leaked store or database cannot be replayed
+*/
 type store struct {
-	users    map[string]*User
-	lock     sync.Mutex
-	database *sql.DB
-	sessions map[string]*User
-	options  *Options
+	users          map[string]*account
+	lock           sync.Mutex
+	repository     *repository
+	sessions       map[string]*session
+	options        *Options
+	stopReaper     func()
+	challenges     map[string]*challenge // pending passkey ceremonies by challenge
+	challengeSweep time.Time             // when expired challenges are dropped next
+	resets         map[string]*reset     // password reset tokens by hash
+	magicLinks     map[string]*magicLink // login link tokens by hash
+	roles          map[string]*role      // roles by name, built-in ones included
+	roleGeneration uint64                // bumped on every role definition change, invalidating the users' permission caches
+}
+
+type reset struct {
+	username string
+	expires  time.Time
+}
+
+type session struct {
+	user     *account
+	created  time.Time
+	lastSeen time.Time
+	stored   time.Time // lastSeen as last written to the database
+	client   auth.Client
+
+	pendingMFA bool // only VerifyTOTP may use the session
 }
 
 func (store *store) get(username string) (*User, error) {
@@ -22,13 +57,23 @@ func (store *store) get(username string) (*User, error) {
 	defer store.lock.Unlock()
 	for _, user := range store.users {
 		if user.username == username {
-			return user, nil
+			return &User{account: user}, nil
 		}
 	}
-	return &User{}, constants.ErrNotFound
+	return &User{account: &account{}}, constants.ErrNotFound
 }
 
 func (store *store) add(user *User) error {
+	passHash, err := store.options.hasher.Hash(user.password)
+	if err != nil {
+		return err
+	}
+	user.password = passHash
+	return store.insert(user)
+}
+
+// Stores a user whose password is already hashed
+func (store *store) insert(user *User) error {
 	store.lock.Lock()
 	defer store.lock.Unlock()
 	for username := range store.users {
@@ -36,54 +81,664 @@ func (store *store) add(user *User) error {
 			return constants.ErrAlreadyExists
 		}
 	}
-	passHash, err := utils.HashPassword(user.password)
+	err := store.repository.insertUser(user)
+	if err != nil {
+		return err
+	}
+	store.users[user.username] = user.account
+	return nil
+}
+
+// Removes the user with everything issued to them and clears the shared account so other handles stop working
+func (store *store) remove(user *User) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	err := store.repository.deleteUser(user.username)
+	if err != nil {
+		return err
+	}
+	for _, session := range store.userSessions(user) {
+		delete(store.sessions, session)
+	}
+	delete(store.users, user.username)
+	store.dropResets(user.username)
+	store.dropMagicLinks(user.username)
+	user.password = ""
+	user.username = ""
+	user.access = -1
+	user.variables = nil
+	return nil
+}
+
+// Sets a new password chosen by the user, the replaced hash moves into the password history
+func (store *store) changePassword(user *User, passHash string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	history := store.rememberPassword(user)
+	now := time.Now()
+	err := store.repository.changePassword(user.username, passHash, history, now)
 	if err != nil {
 		return err
 	}
 	user.password = passHash
-	store.users[user.username] = user
-	statement, err := store.database.Prepare(`INSERT INTO users(username, password, access) VALUES (?, ?, ?)`)
+	user.history = history
+	user.passwordChanged = now
+	user.mustChangePassword = false
+	return nil
+}
+
+func (store *store) requirePasswordChange(user *User) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	err := store.repository.requirePasswordChange(user.username)
+	if err != nil {
+		return err
+	}
+	user.mustChangePassword = true
+	return nil
+}
+
+// Swaps the hash of the unchanged password, e.g. when upgrading the hashing algorithm
+func (store *store) replaceHash(user *User, passHash string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	err := store.repository.updatePassword(user.username, passHash)
 	if err != nil {
 		return err
 	}
-	_, err = statement.Exec(user.username, user.password, user.access)
+	user.password = passHash
+	return nil
+}
+
+// Changes the access level, keys and personal access tokens reaching above it are lowered to it
+func (store *store) changeAccess(user *User, access int) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	err := store.repository.updateAccess(user.username, access)
 	if err != nil {
 		return err
 	}
+	user.access = access
+	for _, key := range user.apiKeys {
+		key.access = max(key.access, access)
+	}
 	return nil
 }
 
-func (store *store) remove(user *User) error {
+func (store *store) setVariable(user *User, key string, value any) error {
+	encoded, err := utils.EncodeVariable(value)
+	if err != nil {
+		return err
+	}
 	store.lock.Lock()
 	defer store.lock.Unlock()
-	statement, err := store.database.Prepare(`DELETE FROM users WHERE username=?`)
+	if user.variables == nil {
+		return constants.ErrNotFound
+	}
+	err = store.repository.setVariable(user.username, key, encoded)
 	if err != nil {
 		return err
 	}
-	_, err = statement.Exec(user.username)
+	user.variables[key] = utils.CloneVariable(value)
+	return nil
+}
+
+func (store *store) deleteVariable(user *User, key string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if user.variables == nil {
+		return constants.ErrNotFound
+	}
+	err := store.repository.deleteVariable(user.username, key)
 	if err != nil {
 		return err
 	}
-	store.RemoveSessions(user.getSessions())
-	for username := range store.users {
-		if user.username == username {
-			delete(store.users, username)
+	delete(user.variables, key)
+	return nil
+}
+
+// Returns the history after the current hash is replaced, newest first and trimmed to the configured length
+func (store *store) rememberPassword(user *User) []string {
+	keep := store.options.UserSettings.PasswordHistory - 1
+	if keep <= 0 {
+		return nil
+	}
+	history := append([]string{user.password}, user.history...)
+	if len(history) > keep {
+		history = history[:keep]
+	}
+	return history
+}
+
+// Checks whether the password is the current one or in the history
+func (store *store) reusedPassword(user *User, password string) bool {
+	if store.options.UserSettings.PasswordHistory <= 0 {
+		return false
+	}
+	store.lock.Lock()
+	hashes := append([]string{user.password}, user.history...)
+	store.lock.Unlock()
+	for _, passHash := range hashes {
+		ok, _ := hasher.Verify(password, passHash)
+		if ok {
+			return true
 		}
 	}
+	return false
+}
+
+// Counts a failed login and locks the account once the threshold is reached
+func (store *store) loginFailed(user *User) error {
+	settings := store.options.UserSettings
+	if settings.LockoutThreshold <= 0 {
+		return nil
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	lockout := user.lockout
+	lockout.FailedAttempts++
+	if lockout.FailedAttempts >= settings.LockoutThreshold {
+		decay := settings.LockoutDecay
+		if decay == 0 {
+			decay = 24 * time.Hour
+		}
+		if time.Since(lockout.LockedUntil) >= decay {
+			lockout.Lockouts = 0
+		}
+		lockout.Lockouts++
+		lockout.FailedAttempts = 0
+		duration := utils.LockoutDuration(settings.LockoutDuration, settings.LockoutMaxDuration, lockout.Lockouts, settings.LockoutBackoff)
+		lockout.LockedUntil = time.Now().Add(duration)
+	}
+	return store.saveLockout(user, lockout)
+}
+
+// Reports whether the account is locked out right now
+func (store *store) locked(user *User) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return user.lockout.Locked()
+}
+
+// Forgets the failed attempts after a successful login, the lockouts driving the backoff only decay
+func (store *store) resetFailures(user *User) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if user.lockout.FailedAttempts == 0 {
+		return nil
+	}
+	lockout := user.lockout
+	lockout.FailedAttempts = 0
+	return store.saveLockout(user, lockout)
+}
+
+// Clears the failed attempts, lockouts and any lock, done by an admin through Unlock
+func (store *store) clearLockout(user *User) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if user.lockout == (auth.Lockout{}) {
+		return nil
+	}
+	return store.saveLockout(user, auth.Lockout{})
+}
+
+// The caller must hold the lock
+func (store *store) saveLockout(user *User, lockout auth.Lockout) error {
+	err := store.repository.updateLockout(user.username, lockout)
+	if err != nil {
+		return err
+	}
+	user.lockout = lockout
 	return nil
 }
 
-func (store *store) newSession(session string, user *User) error {
+func (store *store) enrollTOTP(user *User, secret string) error {
 	store.lock.Lock()
 	defer store.lock.Unlock()
-	if _, ok := store.sessions[session]; ok {
+	err := store.repository.enrollTOTP(user.username, secret)
+	if err != nil {
+		return err
+	}
+	user.totpPending = secret
+	return nil
+}
+
+// Swaps the pending secret in once the code proves the authenticator app has it
+func (store *store) confirmTOTP(user *User, code string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if user.totpPending == "" {
+		return constants.ErrNotFound
+	}
+	counter, ok := totp.Validate(user.totpPending, code, time.Now(), store.options.totpSkew)
+	if !ok {
+		return constants.ErrInvalidCode
+	}
+	err := store.repository.confirmTOTP(user.username, user.totpPending, counter)
+	if err != nil {
+		return err
+	}
+	user.totpSecret = user.totpPending
+	user.totpPending = ""
+	user.totpCounter = counter
+	return nil
+}
+
+func (store *store) disableTOTP(user *User) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	err := store.repository.disableTOTP(user.username)
+	if err != nil {
+		return err
+	}
+	user.totpSecret = ""
+	user.totpPending = ""
+	user.totpCounter = 0
+	return nil
+}
+
+// Accepts each code once, wrong codes count as failed logins
+func (store *store) verifyTOTP(user *User, code string) error {
+	store.lock.Lock()
+	if user.totpSecret == "" {
+		store.lock.Unlock()
+		return constants.ErrNotFound
+	}
+	if user.lockout.Locked() {
+		store.lock.Unlock()
+		return constants.ErrAccountLocked
+	}
+	counter, ok := totp.Validate(user.totpSecret, code, time.Now(), store.options.totpSkew)
+	if !ok || counter <= user.totpCounter {
+		store.lock.Unlock()
+		err := store.loginFailed(user)
+		if err != nil {
+			return err
+		}
+		return constants.ErrInvalidCode
+	}
+	err := store.repository.useTOTP(user.username, counter)
+	if err != nil {
+		store.lock.Unlock()
+		return err
+	}
+	user.totpCounter = counter
+	store.lock.Unlock()
+	return store.resetFailures(user)
+}
+
+func (store *store) setRecoveryCodes(user *User, hashes []string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	err := store.repository.replaceRecoveryCodes(user.username, hashes)
+	if err != nil {
+		return err
+	}
+	user.recoveryCodes = hashes
+	return nil
+}
+
+// Removes the code from the unused ones, wrong codes count as failed logins
+func (store *store) useRecoveryCode(user *User, code string) error {
+	hash := tokens.Hash(tokens.NormalizeReadable(code))
+	store.lock.Lock()
+	if user.lockout.Locked() {
+		store.lock.Unlock()
+		return constants.ErrAccountLocked
+	}
+	for index, unused := range user.recoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(unused), []byte(hash)) != 1 {
+			continue
+		}
+		err := store.repository.useRecoveryCode(user.username, hash)
+		if err != nil {
+			store.lock.Unlock()
+			return err
+		}
+		user.recoveryCodes = append(user.recoveryCodes[:index:index], user.recoveryCodes[index+1:]...)
+		store.lock.Unlock()
+		return store.resetFailures(user)
+	}
+	store.lock.Unlock()
+	err := store.loginFailed(user)
+	if err != nil {
+		return err
+	}
+	return constants.ErrInvalidCode
+}
+
+func (store *store) setEmail(user *User, email string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, other := range store.users {
+		if other != user.account && email != "" && strings.EqualFold(other.email, email) {
+			return constants.ErrAlreadyExists
+		}
+	}
+	now := time.Now()
+	err := store.repository.setEmail(user.username, email, now)
+	if err != nil {
+		return err
+	}
+	user.email = email
+	user.emailVerified = false
+	user.emailChanged = now
+	store.dropResets(user.username)
+	store.dropMagicLinks(user.username)
+	return nil
+}
+
+// Returns the username, address and time it was set that a verification token carries, nil without an address
+func (store *store) verificationClaims(user *User) []string {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if user.email == "" {
+		return nil
+	}
+	return []string{user.username, user.email, strconv.FormatInt(user.emailChanged.UnixNano(), 10)}
+}
+
+// Marks the email as verified once, if it is still the address the token was made for
+func (store *store) verifyEmail(user *User, email, changed string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if user.emailVerified || user.email != email || strconv.FormatInt(user.emailChanged.UnixNano(), 10) != changed {
+		return constants.ErrInvalidToken
+	}
+	err := store.repository.verifyEmail(user.username)
+	if err != nil {
+		return err
+	}
+	user.emailVerified = true
+	return nil
+}
+
+// Mails a token, as a link below the configured base URL when there is one
+func (store *store) send(to, subject, text, path, token string) error {
+	if store.options.mailer == nil {
+		return constants.ErrNoMailer
+	}
+	body := text + ": " + token
+	if link := store.link(path, token); link != "" {
+		body = text + ": " + link
+	}
+	return store.options.mailer.Send(mailer.Message{To: to, Subject: subject, Body: body})
+}
+
+// Builds the link for a token below the configured base URL, empty without one
+func (store *store) link(path, token string) string {
+	if store.options.linkBase == "" {
+		return ""
+	}
+	return store.options.linkBase + path + "?token=" + url.QueryEscape(token)
+}
+
+// Hands the notification to the notifier, falling back to mailing it
+func (store *store) notify(notification notifier.Notification) error {
+	userNotifier := store.options.notifier
+	if userNotifier == nil {
+		if store.options.mailer == nil {
+			return constants.ErrNoMailer
+		}
+		userNotifier = notifier.Mail(store.options.mailer)
+	}
+	return userNotifier.Notify(notification)
+}
+
+// Finds a user by username or, case-insensitively, email address
+func (store *store) find(login string) (*User, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if user, ok := store.users[login]; ok {
+		return &User{account: user}, nil
+	}
+	for _, user := range store.users {
+		if user.email != "" && strings.EqualFold(user.email, login) {
+			return &User{account: user}, nil
+		}
+	}
+	return nil, constants.ErrNotFound
+}
+
+// Stores the hash of a reset token, replacing earlier ones of the user and dropping expired ones
+func (store *store) addReset(user *User, token string, expires time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	now := time.Now()
+	hash := tokens.Hash(token)
+	err := store.repository.insertReset(hash, user.username, expires, now)
+	if err != nil {
+		return err
+	}
+	for existing, reset := range store.resets {
+		if reset.username == user.username || now.After(reset.expires) {
+			delete(store.resets, existing)
+		}
+	}
+	store.resets[hash] = &reset{username: user.username, expires: expires}
+	return nil
+}
+
+// Returns the user a live reset token belongs to without using it up
+func (store *store) findReset(token string) (*User, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	reset, ok := store.resets[tokens.Hash(token)]
+	if !ok || time.Now().After(reset.expires) {
+		return nil, constants.ErrInvalidToken
+	}
+	user, ok := store.users[reset.username]
+	if !ok {
+		return nil, constants.ErrInvalidToken
+	}
+	return &User{account: user}, nil
+}
+
+// Drops the user's reset tokens once the account or the address they were mailed to is gone, the caller must hold the lock
+func (store *store) dropResets(username string) {
+	for hash, reset := range store.resets {
+		if reset.username == username {
+			delete(store.resets, hash)
+		}
+	}
+}
+
+// Uses up a reset token, fails if it was used in the meantime
+func (store *store) takeReset(token string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	hash := tokens.Hash(token)
+	if _, ok := store.resets[hash]; !ok {
+		return constants.ErrInvalidToken
+	}
+	err := store.repository.deleteReset(hash)
+	if err != nil {
+		return err
+	}
+	delete(store.resets, hash)
+	return nil
+}
+
+// Replaces an outdated password hash after a successful login, a failure only postpones the upgrade
+func (store *store) rehash(user *User, password string) {
+	passHash, err := store.options.hasher.Hash(password)
+	if err == nil {
+		err = store.replaceHash(user, passHash)
+	}
+	if err != nil {
+		store.options.logger.Println("rehash(): " + err.Error())
+	}
+}
+
+// Issues a new session token for the user, respecting MaxSessions and RequireVerifiedEmail, service accounts get none
+func (store *store) openSession(user *User, client auth.Client, pendingMFA bool) error {
+	if user.serviceAccount {
+		return constants.ErrNotAllowed
+	}
+	if store.options.UserSettings.RequireVerifiedEmail && !user.EmailVerified() {
+		return constants.ErrEmailNotVerified
+	}
+	if store.options.UserSettings.MaxSessions == len(user.getSessions()) && store.options.UserSettings.MaxSessions > 0 {
+		return constants.ErrAlreadyAuthenticated
+	}
+	token, err := tokens.Generate(store.options.sessionTokenPrefix, store.options.sessionTokenLength)
+	if err != nil {
+		return err
+	}
+	user.session = token
+	return store.newSession(user.session, user, client, pendingMFA)
+}
+
+func (store *store) newSession(token string, user *User, client auth.Client, pendingMFA bool) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	sessionID := tokens.Hash(token)
+	if _, ok := store.sessions[sessionID]; ok {
 		return constants.ErrAlreadyAuthenticated
 	}
-	store.sessions[session] = user
+	now := time.Now()
+	err := store.repository.insertSession(sessionID, user.username, now, client, pendingMFA)
+	if err != nil {
+		return err
+	}
+	store.sessions[sessionID] = &session{user: user.account, created: now, lastSeen: now, stored: now, client: client, pendingMFA: pendingMFA}
+	return nil
+}
+
+// Looks up a session by token, drops it if it has expired and marks it as seen otherwise
+func (store *store) lookupSession(token string) (*session, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	sessionID := tokens.Hash(token)
+	session, ok := store.sessions[sessionID]
+	if !ok {
+		return nil, constants.ErrNotFound
+	}
+	now := time.Now()
+	if store.expired(session, now) {
+		err := store.repository.deleteSessions([]string{sessionID})
+		if err != nil {
+			return nil, err
+		}
+		delete(store.sessions, sessionID)
+		return nil, constants.ErrSessionExpired
+	}
+	// lastSeen is written at most once a minute, or every half idle timeout when one is set and shorter, instead of on every read
+	interval := time.Minute
+	if idleTimeout := store.options.UserSettings.SessionIdleTimeout; idleTimeout > 0 {
+		interval = min(interval, idleTimeout/2)
+	}
+	if now.Sub(session.stored) >= interval {
+		err := store.repository.touchSession(sessionID, now)
+		if err != nil {
+			return nil, err
+		}
+		session.stored = now
+	}
+	session.lastSeen = now
+	return session, nil
+}
+
+func (store *store) pendingMFA(session *session) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return session.pendingMFA
+}
+
+// Lifts the second factor restriction of a session, a no-op for full sessions
+func (store *store) completeMFA(token string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	sessionID := tokens.Hash(token)
+	session, ok := store.sessions[sessionID]
+	if !ok {
+		return constants.ErrNotFound
+	}
+	if !session.pendingMFA {
+		return nil
+	}
+	err := store.repository.completeSession(sessionID)
+	if err != nil {
+		return err
+	}
+	session.pendingMFA = false
+	return nil
+}
+
+// Removes sessions by their hashed id
+func (store *store) removeSessions(sessions []string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	err := store.repository.deleteSessions(sessions)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		delete(store.sessions, session)
+	}
 	return nil
 }
 
-func (store *store) rawAdd(user *User) error {
+// Returns the ids of the user's live sessions, the caller must hold the lock
+func (store *store) userSessions(user *User) []string {
+	var sessions []string
+	now := time.Now()
+	for sessionID, session := range store.sessions {
+		if session.user.username == user.username && !store.expired(session, now) {
+			sessions = append(sessions, sessionID)
+		}
+	}
+	return sessions
+}
+
+// Lists the user's live sessions with their metadata
+func (store *store) sessionInfo(user *User) []auth.Session {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var sessions []auth.Session
+	for _, sessionID := range store.userSessions(user) {
+		session := store.sessions[sessionID]
+		sessions = append(sessions, auth.Session{
+			ID:       sessionID,
+			Created:  session.created,
+			LastSeen: session.lastSeen,
+			Client:   session.client,
+			Current:  sessionID == tokens.Hash(user.session),
+		})
+	}
+	return sessions
+}
+
+func (store *store) expired(session *session, now time.Time) bool {
+	settings := store.options.UserSettings
+	return utils.SessionExpired(now, session.created, session.lastSeen, settings.SessionLifetime, settings.SessionIdleTimeout)
+}
+
+// Purges every expired session, run periodically by the reaper
+func (store *store) reap() {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var expired []string
+	now := time.Now()
+	for sessionID, session := range store.sessions {
+		if store.expired(session, now) {
+			expired = append(expired, sessionID)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	err := store.repository.deleteSessions(expired)
+	if err != nil {
+		store.options.logger.Println("reap(): " + err.Error())
+		return
+	}
+	for _, sessionID := range expired {
+		delete(store.sessions, sessionID)
+	}
+}
+
+func (store *store) rawAdd(user *account) error {
 	store.lock.Lock()
 	defer store.lock.Unlock()
 	for username := range store.users {
@@ -95,6 +750,58 @@ func (store *store) rawAdd(user *User) error {
 	return nil
 }
 
+func (store *store) rawVariable(username, key, value string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	user, ok := store.users[username]
+	if !ok {
+		return nil
+	}
+	decoded, err := utils.DecodeVariable(value)
+	if err != nil {
+		return err
+	}
+	user.variables[key] = decoded
+	return nil
+}
+
+// Loads the password history newest first, hashes beyond a since shortened PasswordHistory are dropped
+func (store *store) rawHistory(username, password string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	user, ok := store.users[username]
+	if !ok || len(user.history) >= store.options.UserSettings.PasswordHistory-1 {
+		return
+	}
+	user.history = append(user.history, password)
+}
+
+func (store *store) rawRecoveryCode(username, code string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	user, ok := store.users[username]
+	if !ok {
+		return
+	}
+	user.recoveryCodes = append(user.recoveryCodes, code)
+}
+
+func (store *store) rawReset(token, username string, expires time.Time) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.resets[token] = &reset{username: username, expires: expires}
+}
+
+func (store *store) rawSession(sessionID, username string, created, lastSeen time.Time, client auth.Client, pendingMFA bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	user, ok := store.users[username]
+	if !ok {
+		return
+	}
+	store.sessions[sessionID] = &session{user: user, created: created, lastSeen: lastSeen, stored: lastSeen, client: client, pendingMFA: pendingMFA}
+}
+
 func (store *store) close() error {
-	return store.database.Close()
+	return store.repository.close()
 }
@@ -1,136 +1,534 @@
 package persistent
 
 import (
+	"fmt"
 	"log"
+	"net/mail"
 	"regexp"
+	"strings"
 	"sync"
+	"time"
 
 	"database/sql"
 
+	"github.com/Varppi/goauthy/internal/tokens"
 	"github.com/Varppi/goauthy/internal/utils"
+	"github.com/Varppi/goauthy/pkg/auth"
 	"github.com/Varppi/goauthy/pkg/constants"
-	"github.com/gofiber/fiber/v2"
-	"github.com/google/uuid"
+	"github.com/Varppi/goauthy/pkg/detector"
+	"github.com/Varppi/goauthy/pkg/hasher"
+	"github.com/Varppi/goauthy/pkg/mailer"
+	"github.com/Varppi/goauthy/pkg/notifier"
+	"github.com/Varppi/goauthy/pkg/policy"
+	"github.com/Varppi/goauthy/pkg/rest"
+	"github.com/Varppi/goauthy/pkg/totp"
+	"github.com/Varppi/goauthy/pkg/webauthn"
 	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/crypto/bcrypt"
 )
 
+var _ auth.Store = (*store)(nil)
+var _ auth.User = (*User)(nil)
+
 type Options struct {
 	database      string
 	usernameRegex *regexp.Regexp
 	passRegex     *regexp.Regexp
 	logger        *log.Logger
 	UserSettings  *UserSettings
+
+	sessionTokenPrefix string
+	sessionTokenLength int
+	hasher             hasher.PasswordHasher
+	policy             *policy.PasswordPolicy
+	detector           *detector.Detector
+	totpIssuer         string
+	totpSkew           int
+	recoveryCodes      int
+	relyingParty       *webauthn.RelyingParty
+	mailer             mailer.Mailer
+	linkBase           string
+	signingKey         []byte
+	notifier           notifier.Notifier
+	scopes             map[string]bool // scopes personal access tokens may carry, nil allows any
 }
 
+/*
+Handed out by Login, UserFromID and UserFromUsername, every call gets its own handle so the token
+one request authenticated with never changes what another request's handle may do
+*/
 type User struct {
-	Variables map[string]any
+	*account
+	session string // session token or API key the handle was obtained with, empty from UserFromUsername
+	lookup  bool   // from UserFromUsername, acts for the admin that looked the user up
+}
+
+// The user's data, shared by all of its handles
+type account struct {
+	variables map[string]any // read through GetVariable, changed through SetVariable so changes are persisted
 	username  string
 	access    int
 	password  string
 	store     *store
-	session   string
+	history   []string // previous password hashes, newest first
+
+	passwordChanged    time.Time
+	mustChangePassword bool
+	lockout            auth.Lockout
+
+	totpSecret  string // active secret, empty while TOTP is off
+	totpPending string // enrolled but not yet confirmed secret
+	totpCounter int64  // last accepted time step, codes up to it are replays
+
+	recoveryCodes []string // hashes of the unused recovery codes
+
+	passkeys []*passkey
+
+	email         string
+	emailVerified bool
+	emailChanged  time.Time // signed into verification tokens so they stop working once the address is set again
+
+	serviceAccount bool // no password, authenticates with API keys only
+	apiKeys        []*apiKey
+
+	roles       []string         // granted with GrantRole, the built-in role follows the access level
+	permissions *permissionCache // resolved by HasPermission, nil until needed
 }
 
 type UserSettings struct {
-	MaxSessions         int  //  0 = infinite  default:0
-	AllowPasswordChange bool //                default:true
-}
-
-// Initializes store Init(logger*, UserSettings*, usernameRegex*, passRegex*)
-func Init(userOptions ...any) (*store, error) {
-	defaultOptions := []any{
-		"goauthy.sqlite3",
-		log.Default(),
-		&UserSettings{0, true},
-		regexp.MustCompile(`^[a-zA-Z0-9+\.+_]+$`),
-		regexp.MustCompile(`.+`),
-	}
-	for index, option := range userOptions {
-		if option != nil && index < len(defaultOptions) {
-			defaultOptions[index] = option
+	MaxSessions         int           //  0 = infinite  default:0
+	AllowPasswordChange bool          //                default:true
+	SessionLifetime     time.Duration //  0 = infinite  default:0
+	SessionIdleTimeout  time.Duration //  0 = infinite  default:0
+	ReapInterval        time.Duration //  0 = 1 minute  default:0
+	PasswordHistory     int           //  0 = disabled  default:0  number of recent passwords, current included, that cannot be reused
+	PasswordMaxAge      time.Duration //  0 = infinite  default:0  older passwords must be changed at the next login
+	LockoutThreshold    int           //  0 = disabled  default:0  failed logins in a row that lock the account
+	LockoutDuration     time.Duration //                default:0  how long a lockout lasts
+	LockoutBackoff      bool          //                default:false  doubles the duration with every consecutive lockout
+	LockoutMaxDuration  time.Duration //  0 = no cap    default:0  upper bound for the backoff
+	LockoutDecay        time.Duration //  0 = 24 hours  default:0  how long after a lockout ended the backoff starts over, only Unlock clears it sooner
+
+	RequireVerifiedEmail bool          //                default:false  logins fail until the email address is verified
+	EmailVerificationTTL time.Duration //  0 = 24 hours  default:0  how long verification tokens stay valid
+	PasswordResetTTL     time.Duration //  0 = 1 hour    default:0  how long password reset tokens stay valid
+	MagicLinkTTL         time.Duration //  0 = 15 min    default:0  how long login links stay valid
+}
+
+// Initializes store Init(WithDatabase(), WithLogger(), WithUserSettings(), WithUsernamePattern(), WithPasswordPattern())
+func Init(userOptions ...Option) (*store, error) {
+	options := defaultOptions()
+	for _, option := range userOptions {
+		if option == nil {
+			continue
+		}
+		err := option(options)
+		if err != nil {
+			return &store{}, err
 		}
 	}
-	options := &Options{
-		database:      defaultOptions[0].(string),
-		logger:        defaultOptions[1].(*log.Logger),
-		UserSettings:  defaultOptions[2].(*UserSettings),
-		usernameRegex: defaultOptions[3].(*regexp.Regexp),
-		passRegex:     defaultOptions[4].(*regexp.Regexp),
-	}
-	database, err := sql.Open("sqlite3", options.database)
+	repository, err := openRepository(options.database)
 	if err != nil {
 		return &store{}, err
 	}
-	_, err = database.Exec("CREATE TABLE IF NOT EXISTS users (username TEXT, password TEXT, access INTEGER)")
+	if options.signingKey == nil {
+		options.signingKey, err = repository.secret("signing_key", 32)
+		if err != nil {
+			repository.close()
+			return &store{}, err
+		}
+	}
+	newStore := &store{
+		users:      make(map[string]*account),
+		lock:       sync.Mutex{},
+		options:    options,
+		repository: repository,
+		sessions:   make(map[string]*session),
+		challenges: make(map[string]*challenge),
+		resets:     make(map[string]*reset),
+		magicLinks: make(map[string]*magicLink),
+		roles:      builtInRoles(),
+	}
+	err = newStore.load()
 	if err != nil {
+		repository.close()
 		return &store{}, err
 	}
-	newStore := &store{
-		users:    make(map[string]*User),
-		lock:     sync.Mutex{},
-		options:  options,
-		database: database,
-		sessions: make(map[string]*User),
+	settings := options.UserSettings
+	if settings.SessionLifetime > 0 || settings.SessionIdleTimeout > 0 {
+		interval := settings.ReapInterval
+		if interval == 0 {
+			interval = time.Minute
+		}
+		newStore.stopReaper = utils.Every(interval, newStore.reap)
 	}
-	users, err := database.Query(`SELECT * FROM users`)
+	return newStore, nil
+}
+
+// Loads the users and everything issued to them from the database
+func (store *store) load() error {
+	err := store.repository.each(`SELECT username, password, access, password_changed, must_change_password,
+		failed_attempts, lockouts, locked_until, totp_secret, totp_pending, totp_counter, email, email_verified, service_account, email_changed FROM users`, func(rows *sql.Rows) error {
+		user := &account{store: store, variables: make(map[string]any)}
+		var passwordChanged, lockedUntil, emailChanged int64
+		err := rows.Scan(&user.username, &user.password, &user.access, &passwordChanged, &user.mustChangePassword,
+			&user.lockout.FailedAttempts, &user.lockout.Lockouts, &lockedUntil, &user.totpSecret, &user.totpPending, &user.totpCounter,
+			&user.email, &user.emailVerified, &user.serviceAccount, &emailChanged)
+		if err != nil {
+			return err
+		}
+		user.passwordChanged = time.Unix(0, passwordChanged)
+		user.emailChanged = time.Unix(0, emailChanged)
+		if lockedUntil != 0 {
+			user.lockout.LockedUntil = time.Unix(0, lockedUntil)
+		}
+		return store.rawAdd(user)
+	})
 	if err != nil {
-		return &store{}, err
+		return err
 	}
-	for users.Next() {
+	err = store.repository.each(`SELECT session, username, created, last_seen, ip, user_agent, device, pending_mfa FROM sessions`, func(rows *sql.Rows) error {
+		var session, username string
+		var created, lastSeen int64
+		var pendingMFA bool
+		client := auth.Client{}
+		err := rows.Scan(&session, &username, &created, &lastSeen, &client.IP, &client.UserAgent, &client.Device, &pendingMFA)
+		if err != nil {
+			return err
+		}
+		store.rawSession(session, username, loadedTime(created), loadedTime(lastSeen), client, pendingMFA)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = store.repository.each(`SELECT username, key, value FROM variables`, func(rows *sql.Rows) error {
+		var username, key, value string
+		err := rows.Scan(&username, &key, &value)
+		if err != nil {
+			return err
+		}
+		return store.rawVariable(username, key, value)
+	})
+	if err != nil {
+		return err
+	}
+	err = store.repository.each(`SELECT username, password FROM password_history ORDER BY position`, func(rows *sql.Rows) error {
 		var username, password string
-		var access int
-		err := users.Scan(&username, &password, &access)
+		err := rows.Scan(&username, &password)
 		if err != nil {
-			return &store{}, err
+			return err
 		}
-		newStore.rawAdd(&User{
-			username:  username,
-			password:  password,
-			access:    access,
-			store:     newStore,
-			Variables: make(map[string]any),
-		})
+		store.rawHistory(username, password)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	return newStore, nil
+	err = store.repository.each(`SELECT username, code FROM recovery_codes`, func(rows *sql.Rows) error {
+		var username, code string
+		err := rows.Scan(&username, &code)
+		if err != nil {
+			return err
+		}
+		store.rawRecoveryCode(username, code)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = store.repository.each(`SELECT token, username, expires FROM password_resets`, func(rows *sql.Rows) error {
+		var token, username string
+		var expires int64
+		err := rows.Scan(&token, &username, &expires)
+		if err != nil {
+			return err
+		}
+		store.rawReset(token, username, time.Unix(0, expires))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = store.repository.each(`SELECT token, username, nonce, expires FROM magic_links`, func(rows *sql.Rows) error {
+		var token string
+		var expires int64
+		link := &magicLink{}
+		err := rows.Scan(&token, &link.username, &link.nonce, &expires)
+		if err != nil {
+			return err
+		}
+		link.expires = time.Unix(0, expires)
+		store.rawMagicLink(token, link)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = store.repository.each(`SELECT id, username, name, public_key, sign_count, aaguid, attestation, created, last_used FROM passkeys`, func(rows *sql.Rows) error {
+		var username string
+		var created, lastUsed int64
+		passkey := &passkey{}
+		err := rows.Scan(&passkey.credential.ID, &username, &passkey.name, &passkey.credential.PublicKey, &passkey.credential.SignCount,
+			&passkey.credential.AAGUID, &passkey.credential.Attestation, &created, &lastUsed)
+		if err != nil {
+			return err
+		}
+		passkey.created = time.Unix(0, created)
+		if lastUsed != 0 {
+			passkey.lastUsed = time.Unix(0, lastUsed)
+		}
+		store.rawPasskey(username, passkey)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = store.repository.each(`SELECT id, username, name, access, created, expires, last_used, scopes FROM api_keys`, func(rows *sql.Rows) error {
+		var username, scopes string
+		var created, expires, lastUsed int64
+		key := &apiKey{}
+		err := rows.Scan(&key.id, &username, &key.name, &key.access, &created, &expires, &lastUsed, &scopes)
+		if err != nil {
+			return err
+		}
+		key.scopes = strings.Fields(scopes)
+		key.created = time.Unix(0, created)
+		if expires != 0 {
+			key.expires = time.Unix(0, expires)
+		}
+		if lastUsed != 0 {
+			key.lastUsed = time.Unix(0, lastUsed)
+			key.stored = key.lastUsed
+		}
+		store.rawAPIKey(username, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = store.repository.each(`SELECT name, permissions, parents FROM roles`, func(rows *sql.Rows) error {
+		var name, permissions, parents string
+		err := rows.Scan(&name, &permissions, &parents)
+		if err != nil {
+			return err
+		}
+		store.rawRole(name, strings.Fields(permissions), strings.Fields(parents))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = store.repository.each(`SELECT username, role FROM user_roles`, func(rows *sql.Rows) error {
+		var username, role string
+		err := rows.Scan(&username, &role)
+		if err != nil {
+			return err
+		}
+		store.rawUserRole(username, role)
+		return nil
+	})
+	return err
+}
+
+// Sessions stored before timestamps were recorded count as created at load time
+func loadedTime(unixNano int64) time.Time {
+	if unixNano == 0 {
+		return time.Now()
+	}
+	return time.Unix(0, unixNano)
 }
 
 // Adds new user Add(username, password, access level)
 func (store *store) Add(username, password string, access int) error {
-	user := &User{
-		username:  username,
-		password:  password,
-		access:    access,
-		Variables: make(map[string]any),
-	}
+	user := &User{account: &account{
+		username:        username,
+		password:        password,
+		access:          access,
+		variables:       make(map[string]any),
+		passwordChanged: time.Now(),
+	}}
 	if !store.options.usernameRegex.Match([]byte(user.username)) || !store.options.passRegex.Match([]byte(user.password)) {
 		return constants.ErrInvalidUsernamePassword
 	}
-	err := store.add(user)
+	err := store.options.policy.Check(username, password)
 	if err != nil {
-		store.options.logger.Println("Add(): " + err.Error())
+		return err
 	}
 	user.store = store
-	return nil
+	err = store.add(user)
+	if err != nil {
+		store.options.logger.Println("Add(): " + err.Error())
+	}
+	return err
+}
+
+/*
+Adds a user with a password hash exported from another system Import(username, password hash, access level)
+Accepts every format hasher.Verify understands, the hash is replaced with the primary hasher on the first login
+*/
+func (store *store) Import(username, passwordHash string, access int) error {
+	if !store.options.usernameRegex.Match([]byte(username)) {
+		return constants.ErrInvalidUsernamePassword
+	}
+	if !hasher.Supported(passwordHash) {
+		return hasher.ErrUnknownHash
+	}
+	user := &User{account: &account{
+		username:        username,
+		password:        passwordHash,
+		access:          access,
+		store:           store,
+		variables:       make(map[string]any),
+		passwordChanged: time.Now(),
+	}}
+	err := store.insert(user)
+	if err != nil {
+		store.options.logger.Println("Import(): " + err.Error())
+	}
+	return err
+}
+
+// Returns the failed login state of the account
+func (store *store) LockoutStatus(username string) (auth.Lockout, error) {
+	user, err := store.get(username)
+	if err != nil {
+		return auth.Lockout{}, err
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return user.lockout, nil
+}
+
+// Lists the accounts that are currently locked
+func (store *store) LockedUsers() []string {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var locked []string
+	for username, user := range store.users {
+		if user.lockout.Locked() {
+			locked = append(locked, username)
+		}
+	}
+	return locked
+}
+
+// Clears the failed logins and any lockout of the account
+func (store *store) Unlock(username string) error {
+	user, err := store.get(username)
+	if err != nil {
+		return err
+	}
+	return store.clearLockout(user)
+}
+
+// Marks the email address a token from SendEmailVerification was sent to as verified
+func (store *store) VerifyEmail(token string) error {
+	claims, err := tokens.Verify(store.options.signingKey, "verify-email", token)
+	if err != nil {
+		return fmt.Errorf("%w: %w", constants.ErrInvalidToken, err)
+	}
+	if len(claims) != 3 {
+		return constants.ErrInvalidToken
+	}
+	user, err := store.get(claims[0])
+	if err != nil {
+		return constants.ErrInvalidToken
+	}
+	return store.verifyEmail(user, claims[1], claims[2])
+}
+
+/*
+Sends a single-use password reset token to the user with that username or email address through the notifier
+Only users with a verified email address get one, unknown logins and unverified users return nil as well
+so the call cannot be used to find out which accounts exist
+*/
+func (store *store) RequestPasswordReset(login string) error {
+	user, err := store.find(login)
+	if err != nil || !user.EmailVerified() {
+		return nil
+	}
+	ttl := store.options.UserSettings.PasswordResetTTL
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	token, err := tokens.Generate("gpr", store.options.sessionTokenLength)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(ttl)
+	err = store.addReset(user, token, expires)
+	if err != nil {
+		return err
+	}
+	return store.notify(notifier.Notification{
+		Kind:     notifier.PasswordReset,
+		Username: user.username,
+		Email:    user.Email(),
+		Token:    token,
+		Link:     store.link("/password/reset", token),
+		Expires:  expires,
+	})
+}
+
+// Checks that a token from RequestPasswordReset is live without using it up, e.g. before asking for the new password
+func (store *store) CheckReset(token string) error {
+	_, err := store.findReset(token)
+	return err
+}
+
+// Sets a new password with a token from RequestPasswordReset and revokes every session of the user
+func (store *store) RedeemReset(token, password string) error {
+	if !store.options.UserSettings.AllowPasswordChange {
+		return constants.ErrNotAllowed
+	}
+	user, err := store.findReset(token)
+	if err != nil {
+		return err
+	}
+	err = user.validateNewPassword(password)
+	if err != nil {
+		return err
+	}
+	hashPass, err := store.options.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	err = store.takeReset(token)
+	if err != nil {
+		return err
+	}
+	err = store.changePassword(user, hashPass)
+	if err != nil {
+		return err
+	}
+	return store.removeSessions(user.getSessions())
 }
 
 // Gets the user object from username
-func (store *store) UserFromUsername(username string) (*User, error) {
+func (store *store) UserFromUsername(username string) (auth.User, error) {
 	user, err := store.get(username)
 	if err != nil {
 		store.options.logger.Println("Get(): " + err.Error())
+		return user, err
 	}
-	return user, err
+	user.lookup = true
+	return user, nil
 }
 
-// Gets the user object from session id
-func (store *store) UserFromID(sessionID string) (*User, error) {
-	for session, user := range store.sessions {
-		if session == sessionID {
-			return user, nil
+// Gets a handle of the user from session token or API key, the handle acts with that token only
+func (store *store) UserFromID(sessionID string) (auth.User, error) {
+	session, err := store.lookupSession(sessionID)
+	if err == constants.ErrNotFound {
+		owner, _, err := store.useAPIKey(sessionID)
+		if err != nil {
+			return &User{account: &account{}}, err
 		}
+		return &User{account: owner, session: sessionID}, nil
+	}
+	if err != nil {
+		return &User{account: &account{}}, err
 	}
-	return &User{}, constants.ErrNotFound
+	return &User{account: session.user, session: sessionID}, nil
 }
 
 // Returns the user's username
@@ -140,7 +538,7 @@ func (user *User) Username() string {
 
 // Returns the user's current session id
 func (user *User) Session() string {
-	if !user.validateSession() {
+	if _, ok := user.handleKey(); !ok && !user.validatePendingSession() {
 		user.session = ""
 	}
 	return user.session
@@ -148,90 +546,382 @@ func (user *User) Session() string {
 
 // Resets user passsword
 func (user *User) ChangePassword(password string) error {
+	if !user.validateRestrictedSession() {
+		return constants.ErrNotAllowed
+	}
+	if !user.store.options.UserSettings.AllowPasswordChange && !user.PasswordChangeRequired() {
+		return constants.ErrNotAllowed
+	}
+	err := user.validateNewPassword(password)
+	if err != nil {
+		return err
+	}
+	hashPass, err := user.store.options.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	return user.store.changePassword(user, hashPass)
+}
+
+/*
+Starts TOTP enrollment and returns the secret as text, otpauth:// URI and QR PNG
+Logins keep working with the password alone until ConfirmTOTP succeeds
+*/
+func (user *User) EnrollTOTP() (auth.TOTPEnrollment, error) {
+	if !user.validateSession() {
+		return auth.TOTPEnrollment{}, constants.ErrNotAllowed
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return auth.TOTPEnrollment{}, err
+	}
+	uri := totp.URI(user.store.options.totpIssuer, user.username, secret)
+	image, err := totp.QR(uri)
+	if err != nil {
+		return auth.TOTPEnrollment{}, err
+	}
+	err = user.store.enrollTOTP(user, secret)
+	if err != nil {
+		return auth.TOTPEnrollment{}, err
+	}
+	return auth.TOTPEnrollment{Secret: secret, URI: uri, QR: image}, nil
+}
+
+// Activates the enrolled secret once the user proves it with a code
+func (user *User) ConfirmTOTP(code string) error {
 	if !user.validateSession() {
 		return constants.ErrNotAllowed
 	}
-	if !user.store.options.usernameRegex.Match([]byte(user.username)) || !user.store.options.passRegex.Match([]byte(password)) {
-		return constants.ErrInvalidUsernamePassword
+	return user.store.confirmTOTP(user, code)
+}
+
+// Turns TOTP off and forgets the secret
+func (user *User) DisableTOTP() error {
+	if !user.validateSession() {
+		return constants.ErrNotAllowed
 	}
-	if !user.store.options.UserSettings.AllowPasswordChange {
+	return user.store.disableTOTP(user)
+}
+
+// Reports whether logins require a TOTP code
+func (user *User) TOTPEnabled() bool {
+	user.store.lock.Lock()
+	defer user.store.lock.Unlock()
+	return user.totpSecret != ""
+}
+
+/*
+Checks a TOTP code, completing a login that returned ErrMFARequired or re-verifying the user before a sensitive action
+Every code is accepted once, wrong codes count towards the account lockout
+*/
+func (user *User) VerifyTOTP(code string) error {
+	if !user.validatePendingSession() {
 		return constants.ErrNotAllowed
 	}
-	hashPass, err := utils.HashPassword(password)
+	err := user.store.verifyTOTP(user, code)
 	if err != nil {
 		return err
 	}
-	statement, err := user.store.database.Prepare(`UPDATE users SET password=? WHERE username=?`)
+	err = user.store.completeMFA(user.session)
 	if err != nil {
 		return err
 	}
-	_, err = statement.Exec(user.password, user.username)
+	if user.PasswordChangeRequired() {
+		return constants.ErrPasswordChangeRequired
+	}
+	return nil
+}
+
+/*
+Replaces the user's recovery codes with a fresh batch and returns them, only their hashes are stored
+so this is the one chance to show them to the user
+*/
+func (user *User) GenerateRecoveryCodes() ([]string, error) {
+	if !user.validateSession() {
+		return nil, constants.ErrNotAllowed
+	}
+	codes := make([]string, user.store.options.recoveryCodes)
+	hashes := make([]string, len(codes))
+	for index := range codes {
+		code, err := tokens.Readable(4)
+		if err != nil {
+			return nil, err
+		}
+		codes[index] = code
+		hashes[index] = tokens.Hash(tokens.NormalizeReadable(code))
+	}
+	err := user.store.setRecoveryCodes(user, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Returns how many unused recovery codes are left
+func (user *User) RecoveryCodesLeft() int {
+	user.store.lock.Lock()
+	defer user.store.lock.Unlock()
+	return len(user.recoveryCodes)
+}
+
+/*
+Uses up a recovery code, completing a login that returned ErrMFARequired when the user lost their device
+or re-verifying the user before a sensitive action, wrong codes count towards the account lockout
+*/
+func (user *User) VerifyRecoveryCode(code string) error {
+	if !user.validatePendingSession() {
+		return constants.ErrNotAllowed
+	}
+	err := user.store.useRecoveryCode(user, code)
+	if err != nil {
+		return err
+	}
+	err = user.store.completeMFA(user.session)
+	if err != nil {
+		return err
+	}
+	if user.PasswordChangeRequired() {
+		return constants.ErrPasswordChangeRequired
+	}
+	return nil
+}
+
+// Returns the user's email address, empty if none was set
+func (user *User) Email() string {
+	user.store.lock.Lock()
+	defer user.store.lock.Unlock()
+	return user.email
+}
+
+/*
+Sets or clears the email address, a new address starts unverified and has to be unique across users
+Needs a full session or a handle from UserFromUsername, which acts for an admin
+*/
+func (user *User) SetEmail(email string) error {
+	if !user.mayManageAccount() {
+		return constants.ErrNotAllowed
+	}
+	if email != "" {
+		address, err := mail.ParseAddress(email)
+		if err != nil || address.Address != email {
+			return constants.ErrInvalidEmail
+		}
+	}
+	return user.store.setEmail(user, email)
+}
+
+// Reports whether the user proved they own the email address
+func (user *User) EmailVerified() bool {
+	user.store.lock.Lock()
+	defer user.store.lock.Unlock()
+	return user.emailVerified
+}
+
+/*
+Mails a signed verification token for the current email address, redeemed once with store.VerifyEmail
+Like SetEmail it needs a full session or a handle from UserFromUsername, users held back by RequireVerifiedEmail rely on the latter
+*/
+func (user *User) SendEmailVerification() error {
+	if !user.mayManageAccount() {
+		return constants.ErrNotAllowed
+	}
+	claims := user.store.verificationClaims(user)
+	if claims == nil {
+		return constants.ErrInvalidEmail
+	}
+	ttl := user.store.options.UserSettings.EmailVerificationTTL
+	if ttl == 0 {
+		ttl = 24 * time.Hour
+	}
+	email := claims[1]
+	token := tokens.Sign(user.store.options.signingKey, "verify-email", claims, time.Now().Add(ttl))
+	return user.store.send(email, "Verify your email address", "Confirm your email address", "/verify-email", token)
+}
+
+// Returns when the password was last changed
+func (user *User) PasswordChangedAt() time.Time {
+	user.store.lock.Lock()
+	defer user.store.lock.Unlock()
+	return user.passwordChanged
+}
+
+// Reports whether the user has to change the password before the session can be used for anything else
+func (user *User) PasswordChangeRequired() bool {
+	user.store.lock.Lock()
+	defer user.store.lock.Unlock()
+	if user.mustChangePassword {
+		return true
+	}
+	maxAge := user.store.options.UserSettings.PasswordMaxAge
+	return maxAge > 0 && time.Since(user.passwordChanged) >= maxAge
+}
+
+/*
+Forces the user to change the password, e.g. after an admin set a temporary one
+Sessions issued before the call are restricted to ChangePassword as well until the user complies
+*/
+func (user *User) RequirePasswordChange() error {
+	return user.store.requirePasswordChange(user)
+}
+
+// Validates a new password against the password pattern, policy and history
+func (user *User) validateNewPassword(password string) error {
+	if !user.store.options.usernameRegex.Match([]byte(user.username)) || !user.store.options.passRegex.Match([]byte(password)) {
+		return constants.ErrInvalidUsernamePassword
+	}
+	err := user.store.options.policy.Check(user.username, password)
 	if err != nil {
 		return err
 	}
-	user.password = hashPass
+	if user.store.reusedPassword(user, password) {
+		return constants.ErrPasswordReused
+	}
 	return nil
 }
 
+// Sets a user variable, supported types: nil, string, bool, int, int64, float64, time.Time, []string, map[string]string
+func (user *User) SetVariable(key string, value any) error {
+	return user.store.setVariable(user, key, value)
+}
+
+// Gets a user variable
+func (user *User) GetVariable(key string) (any, bool) {
+	user.store.lock.Lock()
+	defer user.store.lock.Unlock()
+	value, ok := user.variables[key]
+	return utils.CloneVariable(value), ok
+}
+
+// Deletes a user variable
+func (user *User) DeleteVariable(key string) error {
+	return user.store.deleteVariable(user, key)
+}
+
 // Deletes the user's current session
-func (user *User) LogOut() {
-	user.store.RemoveSessions([]string{user.session})
+func (user *User) LogOut() error {
+	return user.store.RemoveSessions([]string{user.session})
 }
 
 // Deletes all user sessions
-func (user *User) LogOutFully() {
-	user.store.RemoveSessions(user.getSessions())
+func (user *User) LogOutFully() error {
+	return user.store.removeSessions(user.getSessions())
+}
+
+// Lists the user's live sessions with their metadata
+func (user *User) Sessions() ([]auth.Session, error) {
+	if !user.validateSession() {
+		return nil, constants.ErrNotAllowed
+	}
+	return user.store.sessionInfo(user), nil
+}
+
+// Revokes one of the user's sessions, e.g. a lost device, takes the ID listed by Sessions
+func (user *User) RevokeSession(sessionID string) error {
+	if !user.validateSession() {
+		return constants.ErrNotAllowed
+	}
+	for _, session := range user.getSessions() {
+		if session == sessionID {
+			return user.store.removeSessions([]string{sessionID})
+		}
+	}
+	return constants.ErrNotFound
 }
 
 // Deletes the user
-func (user *User) Delete() {
-	user.store.remove(user)
-	user.password = ""
-	user.username = ""
+func (user *User) Delete() error {
+	err := user.store.remove(user)
+	if err != nil {
+		return err
+	}
 	user.session = ""
-	user.access = -1
-	user.Variables = nil
+	return nil
 }
 
 // Revokes the given sessions RemoveSessions([]string{"session id", "session id 2"})
-func (store *store) RemoveSessions(sessions []string) {
-	for _, session := range sessions {
-		delete(store.sessions, session)
+func (store *store) RemoveSessions(sessions []string) error {
+	hashes := make([]string, len(sessions))
+	for index, session := range sessions {
+		hashes[index] = tokens.Hash(session)
 	}
+	return store.removeSessions(hashes)
 }
 
 /*
 Attempts to login with given credentials and returns user object containing a valid session if successful
-Login(username, password, session id*)
+With TOTP enabled the user is returned together with ErrMFARequired and its session only permits VerifyTOTP
+When the password expired or an admin requires a change the user is returned together with ErrPasswordChangeRequired,
+its session only permits ChangePassword until the user complies
+Login(username, password)
 */
-func (store *store) Login(username, password string, sessionID ...string) (*User, error) {
+func (store *store) Login(username, password string) (auth.User, error) {
+	return store.LoginWithClient(username, password, auth.Client{})
+}
+
+/*
+Same as Login but records where the login came from on the session
+LoginWithClient(username, password, auth.Client{IP, UserAgent, Device})
+*/
+func (store *store) LoginWithClient(username, password string, client auth.Client) (auth.User, error) {
+	switch store.options.detector.Check(client.IP) {
+	case detector.Block:
+		return &User{account: &account{}}, constants.ErrSourceBlocked
+	case detector.Challenge:
+		if !client.ChallengeSolved {
+			return &User{account: &account{}}, constants.ErrChallengeRequired
+		}
+	}
 	if !store.options.usernameRegex.Match([]byte(username)) || !store.options.passRegex.Match([]byte(password)) {
-		return &User{}, constants.ErrInvalidUsernamePassword
+		return &User{account: &account{}}, constants.ErrInvalidUsernamePassword
 	}
-	user, err := store.UserFromUsername(username)
+	user, err := store.get(username)
 	if err != nil {
-		return &User{}, err
+		store.options.detector.Failure(client.IP, username)
+		store.options.logger.Println("Get(): " + err.Error())
+		return &User{account: &account{}}, err
+	}
+	if store.locked(user) {
+		store.options.detector.Failure(client.IP, username)
+		return &User{account: &account{}}, constants.ErrAccountLocked
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(user.password), []byte(password))
+	if user.serviceAccount {
+		store.options.detector.Failure(client.IP, username)
+		return &User{account: &account{}}, constants.ErrInvalidCredentials
+	}
+	ok, err := hasher.Verify(password, user.password)
 	if err != nil {
-		return &User{}, err
+		return &User{account: &account{}}, err
 	}
-	if store.options.UserSettings.MaxSessions == len(user.getSessions()) && store.options.UserSettings.MaxSessions > 0 {
-		return &User{}, constants.ErrAlreadyAuthenticated
+	if !ok {
+		store.options.detector.Failure(client.IP, username)
+		err = store.loginFailed(user)
+		if err != nil {
+			return &User{account: &account{}}, err
+		}
+		return &User{account: &account{}}, constants.ErrInvalidCredentials
 	}
-	_sessionID := uuid.NewString()
-	if len(sessionID) == 1 {
-		_sessionID = sessionID[0]
+	err = store.resetFailures(user)
+	if err != nil {
+		return &User{account: &account{}}, err
+	}
+	if store.options.hasher.NeedsRehash(user.password) {
+		store.rehash(user, password)
 	}
-	user.session = _sessionID
-	err = store.newSession(user.session, user)
+	pendingMFA := user.TOTPEnabled()
+	err = store.openSession(user, client, pendingMFA)
 	if err != nil {
-		return &User{}, err
+		return &User{account: &account{}}, err
+	}
+	if pendingMFA {
+		return user, constants.ErrMFARequired
+	}
+	if user.PasswordChangeRequired() {
+		return user, constants.ErrPasswordChangeRequired
 	}
 	return user, nil
 }
 
-// Checks whether user has X level of access
+// Checks whether user has X level of access, through an API key no more than the key's ceiling and never through a personal access token
 func (user *User) CheckAccess(accessLevel int) bool {
 	if user.access == -2 {
 		return false
@@ -240,44 +930,52 @@ func (user *User) CheckAccess(accessLevel int) bool {
 		return true
 	}
 	if (user.access > accessLevel) || !user.validateSession() {
-		return false
+		ceiling, ok := user.apiKeyAccess()
+		return ok && user.access <= accessLevel && ceiling <= accessLevel
 	} else {
 		return true
 	}
 }
 
 // Changes access level to the desired one
-func (user *User) ChangeAccess(accessLevel int) {
-	user.access = accessLevel
+func (user *User) ChangeAccess(accessLevel int) error {
+	return user.store.changeAccess(user, accessLevel)
 }
 
-// Returns all the user's sessions
+// Returns the hashed ids of all the user's sessions
 func (user *User) getSessions() []string {
-	var sessions []string
-	for session, storeUser := range user.store.sessions {
-		if storeUser.username == user.username {
-			sessions = append(sessions, session)
-		}
-	}
-	return sessions
+	user.store.lock.Lock()
+	defer user.store.lock.Unlock()
+	return user.store.userSessions(user)
+}
+
+// Handles from UserFromUsername act for an admin, handles from a login or token need a full session
+func (user *User) mayManageAccount() bool {
+	return user.lookup || user.validateSession()
 }
 
-// Validates that the session is valid
+// Validates that the session is valid, has not expired and is not restricted to changing the password
 func (user *User) validateSession() bool {
-	sessionToValidate := user.session
-	for _, session := range user.getSessions() {
-		if session == sessionToValidate {
-			fromSessionUser, err := user.store.UserFromID(session)
-			if err != nil || user != fromSessionUser {
-				return false
-			}
-			return true
-		}
-	}
-	return false
+	return user.validateRestrictedSession() && !user.PasswordChangeRequired()
+}
+
+// Validates that the session is valid and has not expired, sessions that may only change the password pass
+func (user *User) validateRestrictedSession() bool {
+	session, err := user.store.lookupSession(user.session)
+	return err == nil && session.user == user.account && !user.store.pendingMFA(session)
 }
 
+// Validates that the session is valid and has not expired, sessions still waiting for the second factor pass
+func (user *User) validatePendingSession() bool {
+	session, err := user.store.lookupSession(user.session)
+	return err == nil && session.user == user.account
+}
+
+// Stops the session reaper and closes the database
 func (store *store) Close() error {
+	if store.stopReaper != nil {
+		store.stopReaper()
+	}
 	err := store.close()
 	if err != nil {
 		return err
@@ -286,111 +984,9 @@ func (store *store) Close() error {
 	return nil
 }
 
-type RestSettings struct {
-	Listener string
-	Store    *store
-	Debug    bool
-	Logger   *log.Logger
-}
+type RestSettings = rest.Settings
 
 // Rest api args(persistent.RestSettings)
 func StartRest(settings *RestSettings) error {
-	app := fiber.New(fiber.Config{ServerHeader: "GoAuthy"})
-
-	app.Post("/add", func(c *fiber.Ctx) error {
-		errHandle := func(err error) {
-			if settings.Debug {
-				settings.Logger.Println(err.Error())
-				c.Status(500).Send([]byte(err.Error()))
-			} else {
-				c.Send([]byte(""))
-			}
-		}
-
-		payload := &struct {
-			Username string `json:"username"`
-			Password string `json:"password"`
-			Access   int    `json:"access"`
-		}{}
-		err := c.BodyParser(payload)
-		if err != nil {
-			errHandle(err)
-			return err
-		}
-
-		err = settings.Store.Add(payload.Username, payload.Password, payload.Access)
-		if err != nil {
-			errHandle(err)
-			return err
-		}
-
-		return c.JSON(map[string]string{
-			"status": "success",
-		})
-	})
-
-	app.Post("/delete", func(c *fiber.Ctx) error {
-		errHandle := func(err error) {
-			if settings.Debug {
-				settings.Logger.Println(err.Error())
-				c.Status(500).Send([]byte(err.Error()))
-			} else {
-				c.Send([]byte(""))
-			}
-		}
-
-		payload := &struct {
-			Username string `json:"username"`
-			Password string `json:"password"`
-		}{}
-		err := c.BodyParser(payload)
-		if err != nil {
-			errHandle(err)
-			return err
-		}
-		user, err := settings.Store.Login(payload.Username, payload.Password)
-		if err != nil {
-			errHandle(err)
-			return err
-		}
-		user.Delete()
-
-		return c.JSON(map[string]string{
-			"status": "success",
-		})
-	})
-
-	app.Post("/login", func(c *fiber.Ctx) error {
-		errHandle := func(err error) {
-			if settings.Debug {
-				settings.Logger.Println(err.Error())
-				c.Status(500).Send([]byte(err.Error()))
-			} else {
-				c.Send([]byte(""))
-			}
-		}
-
-		payload := &struct {
-			Username string `json:"username"`
-			Password string `json:"password"`
-		}{}
-		err := c.BodyParser(payload)
-		if err != nil {
-			errHandle(err)
-			return err
-		}
-		user, err := settings.Store.Login(payload.Username, payload.Password)
-		if err != nil {
-			return c.Status(401).JSON(map[string]string{
-				"status": "invalid credentials",
-			})
-		}
-		user.LogOut()
-
-		return c.JSON(map[string]string{
-			"status": "success",
-		})
-	})
-
-	return app.Listen(settings.Listener)
+	return rest.Start(settings)
 }
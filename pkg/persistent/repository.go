@@ -0,0 +1,486 @@
+package persistent
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Varppi/goauthy/internal/tokens"
+	"github.com/Varppi/goauthy/pkg/auth"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var schema = []string{
+	"CREATE TABLE IF NOT EXISTS users (username TEXT, password TEXT, access INTEGER)",
+	"CREATE TABLE IF NOT EXISTS sessions (session TEXT PRIMARY KEY, username TEXT)",
+	"CREATE TABLE IF NOT EXISTS variables (username TEXT, key TEXT, value TEXT, PRIMARY KEY(username, key))",
+	"CREATE TABLE IF NOT EXISTS password_history (username TEXT, password TEXT, position INTEGER)",
+	"CREATE TABLE IF NOT EXISTS secrets (name TEXT PRIMARY KEY, value BLOB)",
+	"CREATE TABLE IF NOT EXISTS password_resets (token TEXT PRIMARY KEY, username TEXT, expires INTEGER)",
+	"CREATE TABLE IF NOT EXISTS magic_links (token TEXT PRIMARY KEY, username TEXT, nonce TEXT, expires INTEGER)",
+	"CREATE TABLE IF NOT EXISTS recovery_codes (username TEXT, code TEXT, PRIMARY KEY(username, code))",
+	`CREATE TABLE IF NOT EXISTS passkeys (id TEXT PRIMARY KEY, username TEXT, name TEXT, public_key BLOB, sign_count INTEGER,
+		aaguid BLOB, attestation TEXT, created INTEGER, last_used INTEGER)`,
+	"CREATE TABLE IF NOT EXISTS roles (name TEXT PRIMARY KEY, permissions TEXT)",
+	"CREATE TABLE IF NOT EXISTS user_roles (username TEXT, role TEXT, PRIMARY KEY(username, role))",
+	"CREATE TABLE IF NOT EXISTS api_keys (id TEXT PRIMARY KEY, username TEXT, name TEXT, access INTEGER, created INTEGER, expires INTEGER, last_used INTEGER)",
+}
+
+// Columns added after a table was first released, created on databases that predate them
+var columns = []struct{ table, name, definition string }{
+	{"sessions", "created", "INTEGER NOT NULL DEFAULT 0"},
+	{"sessions", "last_seen", "INTEGER NOT NULL DEFAULT 0"},
+	{"sessions", "ip", "TEXT NOT NULL DEFAULT ''"},
+	{"sessions", "user_agent", "TEXT NOT NULL DEFAULT ''"},
+	{"sessions", "device", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "password_changed", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "must_change_password", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "failed_attempts", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "lockouts", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "locked_until", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "totp_secret", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "totp_pending", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "totp_counter", "INTEGER NOT NULL DEFAULT 0"},
+	{"sessions", "pending_mfa", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "email", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "email_verified", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "service_account", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "email_changed", "INTEGER NOT NULL DEFAULT 0"},
+	{"api_keys", "scopes", "TEXT NOT NULL DEFAULT ''"},
+	{"roles", "parents", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// Kept in PRAGMA user_version, one-off data migrations only run on databases below their version
+const versionHashedSessions = 1
+
+// Every database write goes through the repository inside a transaction before the cache is touched
+type repository struct {
+	database *sql.DB
+}
+
+func openRepository(path string) (*repository, error) {
+	database, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	repo := &repository{database: database}
+	err = repo.transaction(func(tx *sql.Tx) error {
+		for _, statement := range schema {
+			_, err := tx.Exec(statement)
+			if err != nil {
+				return err
+			}
+		}
+		for _, column := range columns {
+			err := addColumn(tx, column.table, column.name, column.definition)
+			if err != nil {
+				return err
+			}
+		}
+		// Passwords set before their age was tracked start aging at the upgrade
+		_, err := tx.Exec(`UPDATE users SET password_changed=? WHERE password_changed=0`, time.Now().UnixNano())
+		if err != nil {
+			return err
+		}
+		var version int
+		err = tx.QueryRow(`PRAGMA user_version`).Scan(&version)
+		if err != nil {
+			return err
+		}
+		if version < versionHashedSessions {
+			err = hashLegacySessions(tx)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, versionHashedSessions))
+		}
+		return err
+	})
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+	return repo, nil
+}
+
+func addColumn(tx *sql.Tx, table, name, definition string) error {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var existing string
+		err := rows.Scan(&existing)
+		if err != nil {
+			return err
+		}
+		if existing == name {
+			return nil
+		}
+	}
+	rows.Close()
+	_, err = tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + name + ` ` + definition)
+	return err
+}
+
+// Sessions used to be stored as plain tokens, hash them so they keep working after the upgrade
+func hashLegacySessions(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT session FROM sessions`)
+	if err != nil {
+		return err
+	}
+	var legacy []string
+	for rows.Next() {
+		var session string
+		err := rows.Scan(&session)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if !tokens.IsHash(session) {
+			legacy = append(legacy, session)
+		}
+	}
+	rows.Close()
+	for _, session := range legacy {
+		_, err := tx.Exec(`UPDATE sessions SET session=? WHERE session=?`, tokens.Hash(session), session)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *repository) transaction(run func(tx *sql.Tx) error) error {
+	tx, err := repo.database.Begin()
+	if err != nil {
+		return err
+	}
+	err = run(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repo *repository) exec(query string, args ...any) error {
+	return repo.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(query, args...)
+		return err
+	})
+}
+
+// Runs the query and calls scan for every row
+func (repo *repository) each(query string, scan func(rows *sql.Rows) error) error {
+	rows, err := repo.database.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err := scan(rows)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Returns the named secret, generating and storing size random bytes the first time
+func (repo *repository) secret(name string, size int) ([]byte, error) {
+	var value []byte
+	err := repo.transaction(func(tx *sql.Tx) error {
+		err := tx.QueryRow(`SELECT value FROM secrets WHERE name=?`, name).Scan(&value)
+		if err != sql.ErrNoRows {
+			return err
+		}
+		value = make([]byte, size)
+		_, err = rand.Read(value)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO secrets(name, value) VALUES (?, ?)`, name, value)
+		return err
+	})
+	return value, err
+}
+
+func (repo *repository) insertUser(user *User) error {
+	return repo.exec(`INSERT INTO users(username, password, access, password_changed, must_change_password, service_account) VALUES (?, ?, ?, ?, ?, ?)`,
+		user.username, user.password, user.access, user.passwordChanged.UnixNano(), user.mustChangePassword, user.serviceAccount)
+}
+
+func (repo *repository) deleteUser(username string) error {
+	return repo.transaction(func(tx *sql.Tx) error {
+		for _, query := range []string{
+			`DELETE FROM users WHERE username=?`,
+			`DELETE FROM sessions WHERE username=?`,
+			`DELETE FROM variables WHERE username=?`,
+			`DELETE FROM password_history WHERE username=?`,
+			`DELETE FROM recovery_codes WHERE username=?`,
+			`DELETE FROM passkeys WHERE username=?`,
+			`DELETE FROM password_resets WHERE username=?`,
+			`DELETE FROM magic_links WHERE username=?`,
+			`DELETE FROM api_keys WHERE username=?`,
+			`DELETE FROM user_roles WHERE username=?`,
+		} {
+			_, err := tx.Exec(query, username)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (repo *repository) updatePassword(username, password string) error {
+	return repo.exec(`UPDATE users SET password=? WHERE username=?`, password, username)
+}
+
+// Updates the password and replaces the stored password history, newest first
+func (repo *repository) changePassword(username, password string, history []string, changed time.Time) error {
+	return repo.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE users SET password=?, password_changed=?, must_change_password=0 WHERE username=?`,
+			password, changed.UnixNano(), username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM password_history WHERE username=?`, username)
+		if err != nil {
+			return err
+		}
+		for position, previous := range history {
+			_, err := tx.Exec(`INSERT INTO password_history(username, password, position) VALUES (?, ?, ?)`, username, previous, position)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (repo *repository) updateLockout(username string, lockout auth.Lockout) error {
+	var lockedUntil int64
+	if !lockout.LockedUntil.IsZero() {
+		lockedUntil = lockout.LockedUntil.UnixNano()
+	}
+	return repo.exec(`UPDATE users SET failed_attempts=?, lockouts=?, locked_until=? WHERE username=?`,
+		lockout.FailedAttempts, lockout.Lockouts, lockedUntil, username)
+}
+
+// Keeps a TOTP secret until the user confirms it with a first code
+func (repo *repository) enrollTOTP(username, secret string) error {
+	return repo.exec(`UPDATE users SET totp_pending=? WHERE username=?`, secret, username)
+}
+
+func (repo *repository) confirmTOTP(username, secret string, counter int64) error {
+	return repo.exec(`UPDATE users SET totp_secret=?, totp_pending='', totp_counter=? WHERE username=?`, secret, counter, username)
+}
+
+func (repo *repository) disableTOTP(username string) error {
+	return repo.exec(`UPDATE users SET totp_secret='', totp_pending='', totp_counter=0 WHERE username=?`, username)
+}
+
+// Stores the counter of the last accepted code so it cannot be replayed
+func (repo *repository) useTOTP(username string, counter int64) error {
+	return repo.exec(`UPDATE users SET totp_counter=? WHERE username=?`, counter, username)
+}
+
+func (repo *repository) replaceRecoveryCodes(username string, codes []string) error {
+	return repo.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM recovery_codes WHERE username=?`, username)
+		if err != nil {
+			return err
+		}
+		for _, code := range codes {
+			_, err := tx.Exec(`INSERT INTO recovery_codes(username, code) VALUES (?, ?)`, username, code)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (repo *repository) useRecoveryCode(username, code string) error {
+	return repo.exec(`DELETE FROM recovery_codes WHERE username=? AND code=?`, username, code)
+}
+
+func (repo *repository) insertPasskey(username string, passkey *passkey) error {
+	return repo.exec(`INSERT INTO passkeys(id, username, name, public_key, sign_count, aaguid, attestation, created, last_used)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, 0)`, passkey.credential.ID, username, passkey.name, passkey.credential.PublicKey,
+		passkey.credential.SignCount, passkey.credential.AAGUID, passkey.credential.Attestation, passkey.created.UnixNano())
+}
+
+func (repo *repository) deletePasskey(username, id string) error {
+	return repo.exec(`DELETE FROM passkeys WHERE id=? AND username=?`, id, username)
+}
+
+// Stores the signature counter an authenticator reported on login
+func (repo *repository) usePasskey(id string, signCount uint32, lastUsed time.Time) error {
+	return repo.exec(`UPDATE passkeys SET sign_count=?, last_used=? WHERE id=?`, signCount, lastUsed.UnixNano(), id)
+}
+
+func (repo *repository) insertAPIKey(username string, key *apiKey) error {
+	var expires int64
+	if !key.expires.IsZero() {
+		expires = key.expires.UnixNano()
+	}
+	return repo.exec(`INSERT INTO api_keys(id, username, name, access, created, expires, last_used, scopes) VALUES (?, ?, ?, ?, ?, ?, 0, ?)`,
+		key.id, username, key.name, key.access, key.created.UnixNano(), expires, strings.Join(key.scopes, " "))
+}
+
+func (repo *repository) touchAPIKey(id string, lastUsed time.Time) error {
+	return repo.exec(`UPDATE api_keys SET last_used=? WHERE id=?`, lastUsed.UnixNano(), id)
+}
+
+func (repo *repository) deleteAPIKey(username, id string) error {
+	return repo.exec(`DELETE FROM api_keys WHERE id=? AND username=?`, id, username)
+}
+
+// Stores a reset token hash, replacing earlier tokens of the user and dropping expired ones
+func (repo *repository) insertReset(token, username string, expires, now time.Time) error {
+	return repo.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM password_resets WHERE username=? OR expires<?`, username, now.UnixNano())
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO password_resets(token, username, expires) VALUES (?, ?, ?)`, token, username, expires.UnixNano())
+		return err
+	})
+}
+
+func (repo *repository) deleteReset(token string) error {
+	return repo.exec(`DELETE FROM password_resets WHERE token=?`, token)
+}
+
+// Stores a login link token hash, replacing earlier tokens of the user and dropping expired ones
+func (repo *repository) insertMagicLink(token, username, nonce string, expires, now time.Time) error {
+	return repo.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM magic_links WHERE username=? OR expires<?`, username, now.UnixNano())
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO magic_links(token, username, nonce, expires) VALUES (?, ?, ?, ?)`,
+			token, username, nonce, expires.UnixNano())
+		return err
+	})
+}
+
+func (repo *repository) deleteMagicLink(token string) error {
+	return repo.exec(`DELETE FROM magic_links WHERE token=?`, token)
+}
+
+func (repo *repository) defineRole(name string, permissions, parents []string) error {
+	return repo.exec(`INSERT INTO roles(name, permissions, parents) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET permissions=excluded.permissions, parents=excluded.parents`,
+		name, strings.Join(permissions, " "), strings.Join(parents, " "))
+}
+
+// Deletes a role, its grants and stores the remaining parents of the roles that inherited from it
+func (repo *repository) deleteRole(name string, children map[string][]string) error {
+	return repo.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM roles WHERE name=?`, name)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM user_roles WHERE role=?`, name)
+		if err != nil {
+			return err
+		}
+		for child, parents := range children {
+			_, err := tx.Exec(`UPDATE roles SET parents=? WHERE name=?`, strings.Join(parents, " "), child)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (repo *repository) grantRole(username, role string) error {
+	return repo.exec(`INSERT INTO user_roles(username, role) VALUES (?, ?)`, username, role)
+}
+
+func (repo *repository) revokeRole(username, role string) error {
+	return repo.exec(`DELETE FROM user_roles WHERE username=? AND role=?`, username, role)
+}
+
+// Changes the access level and lowers the user's keys that reach above it
+func (repo *repository) updateAccess(username string, access int) error {
+	return repo.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE users SET access=? WHERE username=?`, access, username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE api_keys SET access=? WHERE username=? AND access<?`, access, username, access)
+		return err
+	})
+}
+
+func (repo *repository) requirePasswordChange(username string) error {
+	return repo.exec(`UPDATE users SET must_change_password=1 WHERE username=?`, username)
+}
+
+// Sets the email address, which has to be verified again, and drops the reset tokens and login links mailed to the old one
+func (repo *repository) setEmail(username, email string, changed time.Time) error {
+	return repo.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE users SET email=?, email_verified=0, email_changed=? WHERE username=?`, email, changed.UnixNano(), username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM password_resets WHERE username=?`, username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM magic_links WHERE username=?`, username)
+		return err
+	})
+}
+
+func (repo *repository) verifyEmail(username string) error {
+	return repo.exec(`UPDATE users SET email_verified=1 WHERE username=?`, username)
+}
+
+func (repo *repository) setVariable(username, key, value string) error {
+	return repo.exec(`INSERT INTO variables(username, key, value) VALUES (?, ?, ?)
+		ON CONFLICT(username, key) DO UPDATE SET value=excluded.value`, username, key, value)
+}
+
+func (repo *repository) deleteVariable(username, key string) error {
+	return repo.exec(`DELETE FROM variables WHERE username=? AND key=?`, username, key)
+}
+
+func (repo *repository) insertSession(session, username string, created time.Time, client auth.Client, pendingMFA bool) error {
+	return repo.exec(`INSERT INTO sessions(session, username, created, last_seen, ip, user_agent, device, pending_mfa) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		session, username, created.UnixNano(), created.UnixNano(), client.IP, client.UserAgent, client.Device, pendingMFA)
+}
+
+func (repo *repository) touchSession(session string, lastSeen time.Time) error {
+	return repo.exec(`UPDATE sessions SET last_seen=? WHERE session=?`, lastSeen.UnixNano(), session)
+}
+
+// Marks a session that waited for the second factor as complete
+func (repo *repository) completeSession(session string) error {
+	return repo.exec(`UPDATE sessions SET pending_mfa=0 WHERE session=?`, session)
+}
+
+func (repo *repository) deleteSessions(sessions []string) error {
+	return repo.transaction(func(tx *sql.Tx) error {
+		for _, session := range sessions {
+			_, err := tx.Exec(`DELETE FROM sessions WHERE session=?`, session)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (repo *repository) close() error {
+	return repo.database.Close()
+}
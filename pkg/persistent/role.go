@@ -0,0 +1,303 @@
+package persistent
+
+import (
+	"slices"
+	"sort"
+
+	"github.com/Varppi/goauthy/internal/utils"
+	"github.com/Varppi/goauthy/pkg/auth"
+	"github.com/Varppi/goauthy/pkg/constants"
+)
+
+type role struct {
+	permissions []string
+	parents     []string // roles whose permissions are inherited, never forming a cycle
+	builtIn     bool     // held through the access level, cannot be granted or deleted
+}
+
+// A user's resolved permissions, valid while neither the role definitions nor the user's roles change
+type permissionCache struct {
+	generation  uint64 // store.roleGeneration the permissions were resolved at
+	access      int
+	permissions map[string]bool
+}
+
+// The admin role holds every permission, the user role none until DefineRole gives it some
+func builtInRoles() map[string]*role {
+	return map[string]*role{
+		constants.ADMIN_ROLE: {permissions: []string{"*"}, builtIn: true},
+		constants.USER_ROLE:  {builtIn: true},
+	}
+}
+
+// Returns the built-in role an access level maps onto, empty for PUBLIC and DELETED
+func builtInRole(access int) string {
+	switch {
+	case access == constants.ADMIN:
+		return constants.ADMIN_ROLE
+	case access >= constants.USER:
+		return constants.USER_ROLE
+	}
+	return ""
+}
+
+/*
+Creates a role or replaces the permissions and parents it has, built-in roles can be changed as well
+A role inherits every permission of its parents, which have to exist and may not inherit from the role themselves
+DefineRole(auth.Role{Name: "support-lead", Permissions: []string{"tickets:assign"}, Parents: []string{"support"}})
+*/
+func (store *store) DefineRole(definition auth.Role) error {
+	if !utils.ValidRoleName(definition.Name) {
+		return constants.ErrInvalidRole
+	}
+	for _, permission := range definition.Permissions {
+		if !utils.ValidPermission(permission) {
+			return constants.ErrInvalidRole
+		}
+	}
+	return store.defineRole(definition.Name, slices.Clone(definition.Permissions), slices.Clone(definition.Parents))
+}
+
+// Deletes a role and takes it away from every user and role inheriting from it, built-in roles cannot be deleted
+func (store *store) DeleteRole(name string) error {
+	return store.deleteRole(name)
+}
+
+// Lists every role sorted by name
+func (store *store) Roles() []auth.Role {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var roles []auth.Role
+	for name, role := range store.roles {
+		roles = append(roles, auth.Role{
+			Name:        name,
+			Permissions: slices.Clone(role.permissions),
+			Parents:     slices.Clone(role.parents),
+			BuiltIn:     role.builtIn,
+		})
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles
+}
+
+// Gives the user a role created with DefineRole, built-in roles follow the access level set with ChangeAccess
+func (user *User) GrantRole(name string) error {
+	return user.store.grantRole(user, name)
+}
+
+// Takes a granted role away from the user
+func (user *User) RevokeRole(name string) error {
+	return user.store.revokeRole(user, name)
+}
+
+// Returns the user's roles, the built-in role of its access level first
+func (user *User) Roles() []string {
+	user.store.lock.Lock()
+	defer user.store.lock.Unlock()
+	var roles []string
+	if builtIn := builtInRole(user.access); builtIn != "" {
+		roles = append(roles, builtIn)
+	}
+	return append(roles, user.roles...)
+}
+
+/*
+Checks whether one of the user's roles or the roles they inherit from grants the permission, like CheckAccess it needs a valid session or API key
+Through an API key with a lower ceiling than the owner only the built-in role of the ceiling counts,
+through a personal access token the permission must also be one of the token's scopes
+*/
+func (user *User) HasPermission(permission string) bool {
+	var key *apiKey
+	if !user.validateSession() {
+		handleKey, ok := user.handleKey()
+		if !ok || len(handleKey.scopes) != 0 && !slices.Contains(handleKey.scopes, permission) {
+			return false
+		}
+		key = handleKey
+	}
+	return user.store.grants(user, key, permission)
+}
+
+func (store *store) defineRole(name string, permissions, parents []string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, parent := range parents {
+		if _, ok := store.roles[parent]; !ok {
+			return constants.ErrNotFound
+		}
+	}
+	if store.inherits(parents, name) {
+		return constants.ErrRoleCycle
+	}
+	err := store.repository.defineRole(name, permissions, parents)
+	if err != nil {
+		return err
+	}
+	store.roleGeneration++
+	if existing, ok := store.roles[name]; ok {
+		existing.permissions = permissions
+		existing.parents = parents
+		return nil
+	}
+	store.roles[name] = &role{permissions: permissions, parents: parents}
+	return nil
+}
+
+func (store *store) deleteRole(name string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	role, ok := store.roles[name]
+	if !ok {
+		return constants.ErrNotFound
+	}
+	if role.builtIn {
+		return constants.ErrNotAllowed
+	}
+	children := make(map[string][]string)
+	for child, other := range store.roles {
+		if slices.Contains(other.parents, name) {
+			children[child] = slices.DeleteFunc(slices.Clone(other.parents), func(parent string) bool { return parent == name })
+		}
+	}
+	err := store.repository.deleteRole(name, children)
+	if err != nil {
+		return err
+	}
+	store.roleGeneration++
+	delete(store.roles, name)
+	for child, parents := range children {
+		store.roles[child].parents = parents
+	}
+	for _, user := range store.users {
+		user.roles = slices.DeleteFunc(user.roles, func(granted string) bool { return granted == name })
+	}
+	return nil
+}
+
+func (store *store) grantRole(user *User, name string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	role, ok := store.roles[name]
+	if !ok {
+		return constants.ErrNotFound
+	}
+	if role.builtIn {
+		return constants.ErrNotAllowed
+	}
+	if slices.Contains(user.roles, name) {
+		return nil
+	}
+	err := store.repository.grantRole(user.username, name)
+	if err != nil {
+		return err
+	}
+	user.roles = append(user.roles, name)
+	user.permissions = nil
+	return nil
+}
+
+func (store *store) revokeRole(user *User, name string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	index := slices.Index(user.roles, name)
+	if index < 0 {
+		return constants.ErrNotFound
+	}
+	err := store.repository.revokeRole(user.username, name)
+	if err != nil {
+		return err
+	}
+	user.roles = slices.Delete(user.roles, index, index+1)
+	user.permissions = nil
+	return nil
+}
+
+// Checks the user's roles for the permission, through key only its built-in role when its ceiling is below the owner
+func (store *store) grants(user *User, key *apiKey, permission string) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if user.access == constants.DELETED {
+		return false
+	}
+	var permissions map[string]bool
+	if key != nil && key.access > user.access {
+		permissions = store.resolve([]string{builtInRole(key.access)})
+	} else {
+		permissions = store.effectivePermissions(user)
+	}
+	return permissions["*"] || permissions[permission]
+}
+
+// Returns the permissions of the user's roles and their ancestors, resolved once per change, the caller must hold the lock
+func (store *store) effectivePermissions(user *User) map[string]bool {
+	cache := user.permissions
+	if cache == nil || cache.generation != store.roleGeneration || cache.access != user.access {
+		names := append([]string{builtInRole(user.access)}, user.roles...)
+		cache = &permissionCache{generation: store.roleGeneration, access: user.access, permissions: store.resolve(names)}
+		user.permissions = cache
+	}
+	return cache.permissions
+}
+
+// Collects the permissions of the roles and everything they inherit, the caller must hold the lock
+func (store *store) resolve(names []string) map[string]bool {
+	permissions := make(map[string]bool)
+	seen := make(map[string]bool)
+	for len(names) > 0 {
+		name := names[len(names)-1]
+		names = names[:len(names)-1]
+		role, ok := store.roles[name]
+		if seen[name] || !ok {
+			continue
+		}
+		seen[name] = true
+		for _, permission := range role.permissions {
+			permissions[permission] = true
+		}
+		names = append(names, role.parents...)
+	}
+	return permissions
+}
+
+// Reports whether any of the roles is or inherits from name, the caller must hold the lock
+func (store *store) inherits(roles []string, name string) bool {
+	seen := make(map[string]bool)
+	roles = slices.Clone(roles)
+	for len(roles) > 0 {
+		current := roles[len(roles)-1]
+		roles = roles[:len(roles)-1]
+		if current == name {
+			return true
+		}
+		if seen[current] {
+			continue
+		}
+		seen[current] = true
+		if role, ok := store.roles[current]; ok {
+			roles = append(roles, role.parents...)
+		}
+	}
+	return false
+}
+
+// Loads a role stored with DefineRole, replacing the defaults of a built-in one
+func (store *store) rawRole(name string, permissions, parents []string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if existing, ok := store.roles[name]; ok {
+		existing.permissions = permissions
+		existing.parents = parents
+		return
+	}
+	store.roles[name] = &role{permissions: permissions, parents: parents}
+}
+
+func (store *store) rawUserRole(username, name string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	user, ok := store.users[username]
+	if !ok {
+		return
+	}
+	user.roles = append(user.roles, name)
+}
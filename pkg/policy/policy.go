@@ -0,0 +1,159 @@
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Varppi/goauthy/pkg/constants"
+)
+
+// A broken rule, Rule is a stable identifier a signup form can map to its own text
+type Violation struct {
+	Rule    string
+	Message string
+}
+
+// Returned when a password breaks one or more rules, errors.Is(err, constants.ErrPasswordPolicy) matches it
+type Error struct {
+	Violations []Violation
+}
+
+func (err *Error) Error() string {
+	messages := make([]string, len(err.Violations))
+	for index, violation := range err.Violations {
+		messages[index] = violation.Message
+	}
+	return constants.ErrPasswordPolicy.Error() + ": " + strings.Join(messages, ", ")
+}
+
+func (err *Error) Unwrap() error {
+	return constants.ErrPasswordPolicy
+}
+
+// A single password requirement, returns nil when the password satisfies it
+type Rule interface {
+	Check(username, password string) *Violation
+}
+
+// Adapts a function to the Rule interface
+type RuleFunc func(username, password string) *Violation
+
+func (rule RuleFunc) Check(username, password string) *Violation {
+	return rule(username, password)
+}
+
+// A set of rules that are all checked, so every failure is reported at once
+type PasswordPolicy struct {
+	Rules []Rule
+}
+
+func New(rules ...Rule) *PasswordPolicy {
+	return &PasswordPolicy{Rules: rules}
+}
+
+// Returns a policy with the given rules added after the existing ones
+func (policy *PasswordPolicy) With(rules ...Rule) *PasswordPolicy {
+	return New(append(append([]Rule{}, policy.Rules...), rules...)...)
+}
+
+// Checks the password against every rule, returns *Error listing all violations or nil
+func (policy *PasswordPolicy) Check(username, password string) error {
+	if policy == nil {
+		return nil
+	}
+	var violations []Violation
+	for _, rule := range policy.Rules {
+		violation := rule.Check(username, password)
+		if violation != nil {
+			violations = append(violations, *violation)
+		}
+	}
+	if len(violations) > 0 {
+		return &Error{Violations: violations}
+	}
+	return nil
+}
+
+// At least length characters
+func MinLength(length int) Rule {
+	return RuleFunc(func(username, password string) *Violation {
+		if utf8.RuneCountInString(password) < length {
+			return &Violation{"min_length", fmt.Sprintf("must be at least %d characters long", length)}
+		}
+		return nil
+	})
+}
+
+// At most length characters
+func MaxLength(length int) Rule {
+	return RuleFunc(func(username, password string) *Violation {
+		if utf8.RuneCountInString(password) > length {
+			return &Violation{"max_length", fmt.Sprintf("must be at most %d characters long", length)}
+		}
+		return nil
+	})
+}
+
+// At least count upper case letters
+func Uppercase(count int) Rule {
+	return characterClass("uppercase", "upper case letter", count, unicode.IsUpper)
+}
+
+// At least count lower case letters
+func Lowercase(count int) Rule {
+	return characterClass("lowercase", "lower case letter", count, unicode.IsLower)
+}
+
+// At least count digits
+func Digits(count int) Rule {
+	return characterClass("digits", "digit", count, unicode.IsDigit)
+}
+
+// At least count characters that are neither letters, digits nor spaces
+func Symbols(count int) Rule {
+	return characterClass("symbols", "symbol", count, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+	})
+}
+
+// The password must not contain the username, ignoring case
+func NotContainingUsername() Rule {
+	return RuleFunc(func(username, password string) *Violation {
+		if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+			return &Violation{"username", "must not contain the username"}
+		}
+		return nil
+	})
+}
+
+// The password must match the regex, name and message describe the rule to the user
+func Matching(name string, regex *regexp.Regexp, message string) Rule {
+	return RuleFunc(func(username, password string) *Violation {
+		if !regex.MatchString(password) {
+			return &Violation{name, message}
+		}
+		return nil
+	})
+}
+
+func characterClass(name, description string, count int, matches func(r rune) bool) Rule {
+	return RuleFunc(func(username, password string) *Violation {
+		found := 0
+		for _, r := range password {
+			if matches(r) {
+				found++
+			}
+		}
+		if found < count {
+			plural := ""
+			if count > 1 {
+				plural = "s"
+			}
+			return &Violation{name, fmt.Sprintf("must contain at least %d %s%s", count, description, plural)}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,509 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+
+	"github.com/Varppi/goauthy/pkg/auth"
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/webauthn"
+	"github.com/gofiber/fiber/v2"
+)
+
+type Settings struct {
+	Listener string
+	Store    auth.Store
+	Debug    bool
+	Logger   *log.Logger
+	// Optional, verifies the challenge (e.g. a captcha) a request carries when the store's detector asks for one
+	Challenge func(c *fiber.Ctx) bool
+}
+
+// Rest api args(rest.Settings), works with any auth.Store
+func Start(settings *Settings) error {
+	return New(settings).Listen(settings.Listener)
+}
+
+// Builds the rest api without starting it, useful for mounting or testing
+func New(settings *Settings) *fiber.App {
+	// A copy so the default logger is not written back into the caller's settings
+	local := *settings
+	settings = &local
+	if settings.Logger == nil {
+		settings.Logger = log.Default()
+	}
+	app := fiber.New(fiber.Config{ServerHeader: "GoAuthy"})
+
+	app.Post("/add", func(c *fiber.Ctx) error {
+		errHandle := errHandler(c, settings)
+
+		payload := &struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Access   int    `json:"access"`
+		}{}
+		err := c.BodyParser(payload)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+
+		err = settings.Store.Add(payload.Username, payload.Password, payload.Access)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+
+		return c.JSON(map[string]string{
+			"status": "success",
+		})
+	})
+
+	app.Post("/delete", func(c *fiber.Ctx) error {
+		errHandle := errHandler(c, settings)
+
+		payload := &struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}{}
+		err := c.BodyParser(payload)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+		user, err := settings.Store.Login(payload.Username, payload.Password)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+		err = user.Delete()
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+
+		return c.JSON(map[string]string{
+			"status": "success",
+		})
+	})
+
+	app.Post("/login", func(c *fiber.Ctx) error {
+		errHandle := errHandler(c, settings)
+
+		payload := &credentials{}
+		err := c.BodyParser(payload)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+		user, ok := login(c, settings, payload)
+		if !ok {
+			return nil
+		}
+		user.LogOut()
+
+		return c.JSON(map[string]string{
+			"status": "success",
+		})
+	})
+
+	// Logs in with the password and keeps the session for /passkey/register/finish
+	app.Post("/passkey/register/begin", func(c *fiber.Ctx) error {
+		errHandle := errHandler(c, settings)
+
+		payload := &credentials{}
+		err := c.BodyParser(payload)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+		user, ok := login(c, settings, payload)
+		if !ok {
+			return nil
+		}
+		options, err := user.BeginPasskeyRegistration()
+		if err != nil {
+			user.LogOut()
+			errHandle(err)
+			return err
+		}
+
+		return c.JSON(map[string]any{
+			"status":  "success",
+			"session": user.Session(),
+			"options": options,
+		})
+	})
+
+	app.Post("/passkey/register/finish", func(c *fiber.Ctx) error {
+		errHandle := errHandler(c, settings)
+
+		payload := &struct {
+			Session    string                        `json:"session"`
+			Name       string                        `json:"name"`
+			Credential webauthn.RegistrationResponse `json:"credential"`
+		}{}
+		err := c.BodyParser(payload)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+		user, err := settings.Store.UserFromID(payload.Session)
+		if err != nil {
+			return c.Status(401).JSON(map[string]string{
+				"status": "invalid session",
+			})
+		}
+		defer user.LogOut()
+		err = user.FinishPasskeyRegistration(payload.Name, payload.Credential)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+
+		return c.JSON(map[string]string{
+			"status": "success",
+		})
+	})
+
+	app.Post("/passkey/login/begin", func(c *fiber.Ctx) error {
+		errHandle := errHandler(c, settings)
+
+		payload := &struct {
+			Username string `json:"username"` // optional, empty for discoverable passkeys
+		}{}
+		err := c.BodyParser(payload)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+		options, err := settings.Store.BeginPasskeyLogin(payload.Username)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+
+		return c.JSON(map[string]any{
+			"status":  "success",
+			"options": options,
+		})
+	})
+
+	app.Post("/passkey/login/finish", func(c *fiber.Ctx) error {
+		errHandle := errHandler(c, settings)
+
+		payload := &webauthn.AssertionResponse{}
+		err := c.BodyParser(payload)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+		user, err := settings.Store.FinishPasskeyLogin(*payload, client(c, settings))
+		// Passkeys without user verification leave users with TOTP a pending session for /login/verify
+		if errors.Is(err, constants.ErrMFARequired) {
+			return c.Status(fiber.StatusUnauthorized).JSON(map[string]string{
+				"status":  "code required",
+				"session": user.Session(),
+			})
+		}
+		if !loginResult(c, user, err) {
+			return nil
+		}
+		user.LogOut()
+
+		return c.JSON(map[string]string{
+			"status": "success",
+		})
+	})
+
+	// Always answers success so it cannot be used to probe for accounts
+	app.Post("/password/forgot", func(c *fiber.Ctx) error {
+		errHandle := errHandler(c, settings)
+
+		payload := &struct {
+			Login string `json:"login"` // username or email address
+		}{}
+		err := c.BodyParser(payload)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+		err = settings.Store.RequestPasswordReset(payload.Login)
+		if err != nil {
+			settings.Logger.Println("RequestPasswordReset(): " + err.Error())
+		}
+
+		return c.JSON(map[string]string{
+			"status": "success",
+		})
+	})
+
+	// Target of the mailed reset links, tells the frontend whether the token is still live before it asks for the new password
+	app.Get("/password/reset", func(c *fiber.Ctx) error {
+		err := settings.Store.CheckReset(c.Query("token"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(map[string]string{
+				"status": "invalid token",
+			})
+		}
+
+		return c.JSON(map[string]string{
+			"status": "success",
+		})
+	})
+
+	app.Post("/password/reset", func(c *fiber.Ctx) error {
+		errHandle := errHandler(c, settings)
+
+		payload := &struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}{}
+		err := c.BodyParser(payload)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+		err = settings.Store.RedeemReset(payload.Token, payload.Password)
+		if errors.Is(err, constants.ErrInvalidToken) {
+			return c.Status(fiber.StatusBadRequest).JSON(map[string]string{
+				"status": "invalid token",
+			})
+		}
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+
+		return c.JSON(map[string]string{
+			"status": "success",
+		})
+	})
+
+	// Mails a login link bound to this browser by a cookie, always answers success so it cannot be used to probe for accounts
+	app.Post("/magic/request", func(c *fiber.Ctx) error {
+		errHandle := errHandler(c, settings)
+
+		payload := &struct {
+			Login string `json:"login"` // username or email address
+		}{}
+		err := c.BodyParser(payload)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+		nonce, err := settings.Store.RequestMagicLink(payload.Login, true)
+		if err != nil {
+			settings.Logger.Println("RequestMagicLink(): " + err.Error())
+		}
+		c.Cookie(&fiber.Cookie{
+			Name:     magicCookie,
+			Value:    nonce,
+			Path:     "/",
+			HTTPOnly: true,
+			Secure:   c.Protocol() == "https",
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+
+		return c.JSON(map[string]string{
+			"status": "success",
+		})
+	})
+
+	// Target of the mailed login links, only shows a button posting the token back so mail scanners and prefetchers cannot use it up
+	app.Get("/magic-login", func(c *fiber.Ctx) error {
+		c.Type("html")
+		return c.SendString(fmt.Sprintf(magicLoginPage, html.EscapeString(c.Query("token"))))
+	})
+
+	// Uses up the login link, answers with the session or, for users with TOTP, a pending one for /login/verify
+	app.Post("/magic-login", func(c *fiber.Ctx) error {
+		errHandle := errHandler(c, settings)
+
+		payload := &struct {
+			Token string `json:"token" form:"token"`
+		}{}
+		err := c.BodyParser(payload)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+		user, err := settings.Store.LoginWithMagicLink(payload.Token, c.Cookies(magicCookie), client(c, settings))
+		c.ClearCookie(magicCookie)
+		if errors.Is(err, constants.ErrMFARequired) {
+			return c.Status(fiber.StatusUnauthorized).JSON(map[string]string{
+				"status":  "code required",
+				"session": user.Session(),
+			})
+		}
+		if errors.Is(err, constants.ErrInvalidToken) {
+			return c.Status(fiber.StatusBadRequest).JSON(map[string]string{
+				"status": "invalid token",
+			})
+		}
+		if !loginResult(c, user, err) {
+			return nil
+		}
+
+		return c.JSON(map[string]string{
+			"status":  "success",
+			"session": user.Session(),
+		})
+	})
+
+	// Completes a pending session with a TOTP or recovery code
+	app.Post("/login/verify", func(c *fiber.Ctx) error {
+		errHandle := errHandler(c, settings)
+
+		payload := &struct {
+			Session  string `json:"session"`
+			Code     string `json:"code"`
+			Recovery string `json:"recovery_code"`
+		}{}
+		err := c.BodyParser(payload)
+		if err != nil {
+			errHandle(err)
+			return err
+		}
+		user, err := settings.Store.UserFromID(payload.Session)
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(map[string]string{
+				"status": "invalid session",
+			})
+		}
+		if payload.Code != "" {
+			err = user.VerifyTOTP(payload.Code)
+		} else {
+			err = user.VerifyRecoveryCode(payload.Recovery)
+		}
+		if err != nil && !errors.Is(err, constants.ErrPasswordChangeRequired) {
+			return c.Status(fiber.StatusUnauthorized).JSON(map[string]string{
+				"status": "invalid code",
+			})
+		}
+		if !loginResult(c, user, err) {
+			return nil
+		}
+
+		return c.JSON(map[string]string{
+			"status":  "success",
+			"session": user.Session(),
+		})
+	})
+
+	// Target of the links SendEmailVerification mails when the store's link base points at this api
+	app.Get("/verify-email", func(c *fiber.Ctx) error {
+		err := settings.Store.VerifyEmail(c.Query("token"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(map[string]string{
+				"status": "invalid token",
+			})
+		}
+
+		return c.JSON(map[string]string{
+			"status": "success",
+		})
+	})
+
+	return app
+}
+
+// Cookie holding the nonce that binds a login link to the browser that asked for it
+const magicCookie = "goauthy_magic"
+
+// Confirmation page of /magic-login, the token is filled in escaped
+const magicLoginPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Log in</title></head>
+<body>
+<form method="post" action="magic-login">
+<input type="hidden" name="token" value="%s">
+<button type="submit">Log in</button>
+</form>
+</body>
+</html>
+`
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Code     string `json:"code"`          // TOTP code, only needed when the user enabled it
+	Recovery string `json:"recovery_code"` // replaces the TOTP code when the user lost their device
+	Device   string `json:"device"`        // optional label for the new session, e.g. "work laptop"
+}
+
+func client(c *fiber.Ctx, settings *Settings) auth.Client {
+	return auth.Client{
+		IP:              c.IP(),
+		UserAgent:       c.Get(fiber.HeaderUserAgent),
+		ChallengeSolved: settings.Challenge != nil && settings.Challenge(c),
+	}
+}
+
+// Logs in including the second factor, responds and returns false if no full session came out of it
+func login(c *fiber.Ctx, settings *Settings, payload *credentials) (auth.User, bool) {
+	loginClient := client(c, settings)
+	loginClient.Device = payload.Device
+	user, err := settings.Store.LoginWithClient(payload.Username, payload.Password, loginClient)
+	if errors.Is(err, constants.ErrMFARequired) {
+		switch {
+		case payload.Code != "":
+			err = user.VerifyTOTP(payload.Code)
+		case payload.Recovery != "":
+			err = user.VerifyRecoveryCode(payload.Recovery)
+		default:
+			user.LogOut()
+			c.Status(401).JSON(map[string]string{
+				"status": "code required",
+			})
+			return nil, false
+		}
+		if err != nil && !errors.Is(err, constants.ErrPasswordChangeRequired) {
+			user.LogOut()
+			c.Status(401).JSON(map[string]string{
+				"status": "invalid code",
+			})
+			return nil, false
+		}
+	}
+	return user, loginResult(c, user, err)
+}
+
+// Responds to a failed login, returns true if err is nil
+func loginResult(c *fiber.Ctx, user auth.User, err error) bool {
+	status, message := 0, ""
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, constants.ErrSourceBlocked):
+		status, message = fiber.StatusTooManyRequests, "too many failed logins"
+	case errors.Is(err, constants.ErrChallengeRequired):
+		status, message = fiber.StatusUnauthorized, "challenge required"
+	case errors.Is(err, constants.ErrPasswordChangeRequired):
+		user.LogOut()
+		status, message = fiber.StatusForbidden, "password change required"
+	case errors.Is(err, constants.ErrEmailNotVerified):
+		status, message = fiber.StatusForbidden, "email not verified"
+	case errors.Is(err, constants.ErrAccountLocked):
+		status, message = fiber.StatusLocked, "account locked"
+	default:
+		status, message = fiber.StatusUnauthorized, "invalid credentials"
+	}
+	c.Status(status).JSON(map[string]string{
+		"status": message,
+	})
+	return false
+}
+
+func errHandler(c *fiber.Ctx, settings *Settings) func(err error) {
+	return func(err error) {
+		if settings.Debug {
+			settings.Logger.Println(err.Error())
+			c.Status(500).Send([]byte(err.Error()))
+		} else {
+			c.Send([]byte(""))
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"math/big"
+)
+
+// COSE algorithm identifiers accepted for credentials, in order of preference
+const (
+	ES256 = -7
+	EdDSA = -8
+	RS256 = -257
+)
+
+var ErrUnsupportedKey = errors.New("unsupported credential public key")
+
+// Parses a COSE_Key into the algorithm it is used with and a crypto public key
+func parseCOSEKey(raw []byte) (int64, crypto.PublicKey, error) {
+	decoded, rest, err := decodeCBOR(raw)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(rest) != 0 {
+		return 0, nil, ErrUnsupportedKey
+	}
+	key, ok := decoded.(map[any]any)
+	if !ok {
+		return 0, nil, ErrUnsupportedKey
+	}
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == ES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return 0, nil, ErrUnsupportedKey
+		}
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			return 0, nil, ErrUnsupportedKey
+		}
+		return alg, public, nil
+	case kty == 1 && alg == EdDSA:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return 0, nil, ErrUnsupportedKey
+		}
+		return alg, ed25519.PublicKey(x), nil
+	case kty == 3 && alg == RS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, ErrUnsupportedKey
+		}
+		return alg, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return 0, nil, ErrUnsupportedKey
+}
+
+// Checks a signature made with alg over data
+func verifySignature(alg int64, public crypto.PublicKey, data, signature []byte) error {
+	digest := sha256.Sum256(data)
+	switch alg {
+	case ES256:
+		key, ok := public.(*ecdsa.PublicKey)
+		if ok && ecdsa.VerifyASN1(key, digest[:], signature) {
+			return nil
+		}
+	case EdDSA:
+		key, ok := public.(ed25519.PublicKey)
+		if ok && ed25519.Verify(key, data, signature) {
+			return nil
+		}
+	case RS256:
+		key, ok := public.(*rsa.PublicKey)
+		if ok && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	default:
+		return ErrUnsupportedKey
+	}
+	return ErrInvalidSignature
+}
+
+// Checks a signature made by the key of an attestation certificate
+func verifyCertificateSignature(alg int64, certificate *x509.Certificate, data, signature []byte) error {
+	switch alg {
+	case ES256, EdDSA, RS256:
+		return verifySignature(alg, certificate.PublicKey, data, signature)
+	}
+	return ErrUnsupportedKey
+}
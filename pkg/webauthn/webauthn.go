@@ -0,0 +1,412 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidResponse   = errors.New("malformed authenticator response")
+	ErrInvalidClientData = errors.New("client data does not match the ceremony")
+	ErrInvalidSignature  = errors.New("invalid authenticator signature")
+	ErrUserNotPresent    = errors.New("authenticator did not confirm user presence or verification")
+	ErrUnsupportedFormat = errors.New("unsupported attestation format")
+	ErrCounterRegressed  = errors.New("signature counter did not increase, the authenticator may be cloned")
+)
+
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+var encoding = base64.RawURLEncoding
+
+/*
+Settings of the site passkeys are bound to
+webauthn.RelyingParty{ID: "example.com", Name: "Example", Origins: []string{"https://example.com"}}
+*/
+type RelyingParty struct {
+	ID                      string        // domain the credentials are scoped to
+	Name                    string        // shown by the browser during registration
+	Origins                 []string      // origins the ceremonies may run on, e.g. https://example.com
+	RequireUserVerification bool          //  default:false  demand PIN or biometrics, not only presence
+	Timeout                 time.Duration //  default:5m  how long a challenge stays valid
+}
+
+// A registered credential, what the store keeps per passkey
+type Credential struct {
+	ID          string // base64url credential id
+	PublicKey   []byte // COSE_Key
+	SignCount   uint32
+	AAGUID      []byte // authenticator model, all zero for "none" attestation
+	Attestation string // attestation format that was verified
+}
+
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// Options for navigator.credentials.create, binary fields are base64url like PublicKeyCredential.parseCreationOptionsFromJSON expects
+type CreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams []struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	} `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	Attestation            string                 `json:"attestation"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+}
+
+// Options for navigator.credentials.get, see CreationOptions
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// PublicKeyCredential.toJSON() of a registration
+type RegistrationResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// PublicKeyCredential.toJSON() of an authentication
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	raw        []byte
+	rpIDHash   []byte
+	flags      byte
+	signCount  uint32
+	aaguid     []byte
+	credential []byte
+	publicKey  []byte
+}
+
+// Generates a random challenge, base64url encoded
+func NewChallenge() (string, error) {
+	challenge := make([]byte, 32)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(challenge), nil
+}
+
+// Returns how long challenges stay valid
+func (rp *RelyingParty) ChallengeTimeout() time.Duration {
+	if rp.Timeout <= 0 {
+		return 5 * time.Minute
+	}
+	return rp.Timeout
+}
+
+func (rp *RelyingParty) userVerification() string {
+	if rp.RequireUserVerification {
+		return "required"
+	}
+	return "preferred"
+}
+
+// Builds the options of a registration ceremony, exclude lists credentials the user already has
+func (rp *RelyingParty) CreationOptions(challenge string, userID []byte, username string, exclude []string) CreationOptions {
+	options := CreationOptions{Challenge: challenge, Timeout: rp.ChallengeTimeout().Milliseconds(), Attestation: "direct"}
+	options.RP.ID = rp.ID
+	options.RP.Name = rp.Name
+	options.User.ID = encoding.EncodeToString(userID)
+	options.User.Name = username
+	options.User.DisplayName = username
+	for _, alg := range []int{ES256, EdDSA, RS256} {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, struct {
+			Type string `json:"type"`
+			Alg  int    `json:"alg"`
+		}{"public-key", alg})
+	}
+	options.ExcludeCredentials = descriptors(exclude)
+	options.AuthenticatorSelection.ResidentKey = "preferred"
+	options.AuthenticatorSelection.UserVerification = rp.userVerification()
+	return options
+}
+
+// Builds the options of an authentication ceremony, an empty allow list lets the user pick a discoverable credential
+func (rp *RelyingParty) RequestOptions(challenge string, allow []string) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          rp.ChallengeTimeout().Milliseconds(),
+		AllowCredentials: descriptors(allow),
+		UserVerification: rp.userVerification(),
+	}
+}
+
+// Returns the challenge the response answers, used to find the pending ceremony
+func (response RegistrationResponse) Challenge() (string, error) {
+	return challengeOf(response.Response.ClientDataJSON)
+}
+
+// Returns the challenge the response answers, used to find the pending ceremony
+func (response AssertionResponse) Challenge() (string, error) {
+	return challengeOf(response.Response.ClientDataJSON)
+}
+
+/*
+Verifies a registration ceremony against the challenge it was started with and returns the new credential
+"none" and "packed" (self and x5c) attestations are accepted, x5c chains are not checked against a trust store
+*/
+func (rp *RelyingParty) VerifyRegistration(response RegistrationResponse, challenge string) (Credential, error) {
+	rawClientData, err := rp.verifyClientData(response.Response.ClientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return Credential{}, err
+	}
+	rawAttestation, err := decode(response.Response.AttestationObject)
+	if err != nil {
+		return Credential{}, err
+	}
+	decoded, rest, err := decodeCBOR(rawAttestation)
+	if err != nil || len(rest) != 0 {
+		return Credential{}, ErrInvalidResponse
+	}
+	attestation, ok := decoded.(map[any]any)
+	if !ok {
+		return Credential{}, ErrInvalidResponse
+	}
+	format, _ := attestation["fmt"].(string)
+	statement, _ := attestation["attStmt"].(map[any]any)
+	rawAuthData, _ := attestation["authData"].([]byte)
+	if statement == nil {
+		return Credential{}, ErrInvalidResponse
+	}
+	authData, err := rp.verifyAuthenticatorData(rawAuthData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if authData.flags&flagAttested == 0 {
+		return Credential{}, ErrInvalidResponse
+	}
+	if response.ID != "" && response.ID != encoding.EncodeToString(authData.credential) {
+		return Credential{}, ErrInvalidResponse
+	}
+	alg, publicKey, err := parseCOSEKey(authData.publicKey)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	clientDataHash := sha256.Sum256(rawClientData)
+	signed := append(append([]byte(nil), authData.raw...), clientDataHash[:]...)
+	switch format {
+	case "none":
+		if len(statement) != 0 {
+			return Credential{}, ErrInvalidResponse
+		}
+	case "packed":
+		statementAlg, _ := statement["alg"].(int64)
+		signature, _ := statement["sig"].([]byte)
+		chain, hasChain := statement["x5c"].([]any)
+		if hasChain {
+			if len(chain) == 0 {
+				return Credential{}, ErrInvalidResponse
+			}
+			leaf, _ := chain[0].([]byte)
+			certificate, err := x509.ParseCertificate(leaf)
+			if err != nil {
+				return Credential{}, ErrInvalidResponse
+			}
+			if certificate.IsCA || certificate.Version != 3 {
+				return Credential{}, ErrInvalidResponse
+			}
+			err = verifyCertificateSignature(statementAlg, certificate, signed, signature)
+			if err != nil {
+				return Credential{}, err
+			}
+		} else {
+			// self attestation is signed by the credential itself
+			if statementAlg != alg {
+				return Credential{}, ErrInvalidResponse
+			}
+			err = verifySignature(alg, publicKey, signed, signature)
+			if err != nil {
+				return Credential{}, err
+			}
+		}
+	default:
+		return Credential{}, ErrUnsupportedFormat
+	}
+
+	return Credential{
+		ID:          encoding.EncodeToString(authData.credential),
+		PublicKey:   authData.publicKey,
+		SignCount:   authData.signCount,
+		AAGUID:      authData.aaguid,
+		Attestation: format,
+	}, nil
+}
+
+// What a verified authentication ceremony proved, returned by VerifyAssertion
+type Assertion struct {
+	SignCount    uint32 // the authenticator's new signature counter
+	UserVerified bool   // the authenticator checked a PIN or biometric rather than only the user's presence
+}
+
+// Verifies an authentication ceremony made with credential
+func (rp *RelyingParty) VerifyAssertion(response AssertionResponse, challenge string, credential Credential) (Assertion, error) {
+	if response.ID != credential.ID {
+		return Assertion{}, ErrInvalidResponse
+	}
+	rawClientData, err := rp.verifyClientData(response.Response.ClientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return Assertion{}, err
+	}
+	rawAuthData, err := decode(response.Response.AuthenticatorData)
+	if err != nil {
+		return Assertion{}, err
+	}
+	authData, err := rp.verifyAuthenticatorData(rawAuthData)
+	if err != nil {
+		return Assertion{}, err
+	}
+	signature, err := decode(response.Response.Signature)
+	if err != nil {
+		return Assertion{}, err
+	}
+	alg, publicKey, err := parseCOSEKey(credential.PublicKey)
+	if err != nil {
+		return Assertion{}, err
+	}
+	clientDataHash := sha256.Sum256(rawClientData)
+	err = verifySignature(alg, publicKey, append(append([]byte(nil), rawAuthData...), clientDataHash[:]...), signature)
+	if err != nil {
+		return Assertion{}, err
+	}
+	// authenticators without a counter always report 0
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return Assertion{}, ErrCounterRegressed
+	}
+	return Assertion{SignCount: authData.signCount, UserVerified: authData.flags&flagUserVerified != 0}, nil
+}
+
+func (rp *RelyingParty) verifyClientData(encoded, ceremony, challenge string) ([]byte, error) {
+	raw, err := decode(encoded)
+	if err != nil {
+		return nil, err
+	}
+	data := clientData{}
+	err = json.Unmarshal(raw, &data)
+	if err != nil {
+		return nil, ErrInvalidResponse
+	}
+	if data.Type != ceremony || data.Challenge != challenge || !slices.Contains(rp.Origins, data.Origin) {
+		return nil, ErrInvalidClientData
+	}
+	return raw, nil
+}
+
+func (rp *RelyingParty) verifyAuthenticatorData(raw []byte) (authenticatorData, error) {
+	if len(raw) < 37 {
+		return authenticatorData{}, ErrInvalidResponse
+	}
+	data := authenticatorData{raw: raw, rpIDHash: raw[:32], flags: raw[32], signCount: binary.BigEndian.Uint32(raw[33:37])}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(data.rpIDHash, rpIDHash[:]) {
+		return authenticatorData{}, ErrInvalidClientData
+	}
+	if data.flags&flagUserPresent == 0 || rp.RequireUserVerification && data.flags&flagUserVerified == 0 {
+		return authenticatorData{}, ErrUserNotPresent
+	}
+	if data.flags&flagAttested == 0 {
+		return data, nil
+	}
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return authenticatorData{}, ErrInvalidResponse
+	}
+	data.aaguid = rest[:16]
+	length := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < length || length == 0 {
+		return authenticatorData{}, ErrInvalidResponse
+	}
+	data.credential = rest[:length]
+	rest = rest[length:]
+	_, extensions, err := decodeCBOR(rest)
+	if err != nil {
+		return authenticatorData{}, ErrInvalidResponse
+	}
+	data.publicKey = rest[:len(rest)-len(extensions)]
+	return data, nil
+}
+
+func challengeOf(encoded string) (string, error) {
+	raw, err := decode(encoded)
+	if err != nil {
+		return "", err
+	}
+	data := clientData{}
+	err = json.Unmarshal(raw, &data)
+	if err != nil || data.Challenge == "" {
+		return "", ErrInvalidResponse
+	}
+	return data.Challenge, nil
+}
+
+func descriptors(ids []string) []CredentialDescriptor {
+	list := []CredentialDescriptor{}
+	for _, id := range ids {
+		list = append(list, CredentialDescriptor{Type: "public-key", ID: id})
+	}
+	return list
+}
+
+// Accepts base64url with or without padding
+func decode(value string) ([]byte, error) {
+	decoded, err := encoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, ErrInvalidResponse
+	}
+	return decoded, nil
+}
@@ -0,0 +1,118 @@
+package test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/memory"
+	"github.com/Varppi/goauthy/pkg/persistent"
+)
+
+func TestPersonalTokens(t *testing.T) {
+	stores := testStores(t,
+		[]memory.Option{memory.WithScopes("read:profile", "admin:users")},
+		[]persistent.Option{persistent.WithScopes("read:profile", "admin:users")},
+	)
+	for name, store := range stores {
+		store.Add("user", "test", constants.USER)
+		user, err := store.Login("user", "test")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !user.HasScope("admin:users") {
+			t.Fatal(name, "session was limited to scopes")
+		}
+		_, err = user.CreatePersonalToken("cli", []string{"write:everything"}, time.Time{})
+		if !errors.Is(err, constants.ErrInvalidScope) {
+			t.Fatal(name, "unknown scope was accepted", err)
+		}
+		_, err = user.CreatePersonalToken("cli", nil, time.Time{})
+		if !errors.Is(err, constants.ErrInvalidScope) {
+			t.Fatal(name, "token without scopes was accepted", err)
+		}
+
+		token, err := user.CreatePersonalToken("cli", []string{"read:profile"}, time.Time{})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		listed, err := user.PersonalTokens()
+		if err != nil || len(listed) != 1 || listed[0].Scopes[0] != "read:profile" {
+			t.Fatal(name, "unexpected token listing", listed, err)
+		}
+		keys, _ := user.APIKeys()
+		if len(keys) != 0 {
+			t.Fatal(name, "personal access token listed as API key", keys)
+		}
+		if user.RevokeAPIKey(listed[0].ID) == nil {
+			t.Fatal(name, "personal access token revoked as API key")
+		}
+
+		scoped, err := store.UserFromID(token)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !scoped.CheckScopedAccess(constants.USER, "read:profile") {
+			t.Fatal(name, "granted scope was refused")
+		}
+		if scoped.HasScope("admin:users") || scoped.CheckScopedAccess(constants.USER, "admin:users") {
+			t.Fatal(name, "token exceeded its scopes")
+		}
+		if scoped.CheckScopedAccess(constants.ADMIN, "read:profile") {
+			t.Fatal(name, "token exceeded the owner's access")
+		}
+		if scoped.CheckAccess(constants.USER) {
+			t.Fatal(name, "token passed an access check without a scope")
+		}
+		_, err = scoped.CreatePersonalToken("escalate", []string{"admin:users"}, time.Time{})
+		if !errors.Is(err, constants.ErrNotAllowed) {
+			t.Fatal(name, "token could mint another token", err)
+		}
+
+		store.Add("admin", "test", constants.ADMIN)
+		admin, _ := store.Login("admin", "test")
+		adminToken, _ := admin.CreatePersonalToken("cli", []string{"read:profile"}, time.Time{})
+		adminScoped, _ := store.UserFromID(adminToken)
+		if adminScoped.CheckAccess(constants.ADMIN) || !adminScoped.CheckScopedAccess(constants.ADMIN, "read:profile") {
+			t.Fatal(name, "admin token was not limited to scoped checks")
+		}
+
+		user, _ = store.Login("user", "test")
+		err = user.RevokePersonalToken(listed[0].ID)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		_, err = store.UserFromID(token)
+		if err == nil {
+			t.Fatal(name, "revoked token was accepted")
+		}
+		store.Close()
+	}
+}
+
+func TestPersistentPersonalTokens(t *testing.T) {
+	database := persistent.WithDatabase(filepath.Join(t.TempDir(), "goauthy.sqlite3"))
+	store, err := persistent.Init(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add("user", "test", constants.USER)
+	user, _ := store.Login("user", "test")
+	token, err := user.CreatePersonalToken("cli", []string{"read:profile", "read:repo"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = persistent.Init(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	scoped, err := store.UserFromID(token)
+	if err != nil || !scoped.HasScope("read:repo") || scoped.HasScope("admin:users") {
+		t.Fatal("token scopes did not survive a restart", err)
+	}
+}
@@ -0,0 +1,195 @@
+package test
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/persistent"
+)
+
+func TestAPIKeys(t *testing.T) {
+	for name, store := range testStores(t, nil, nil) {
+		err := store.AddServiceAccount("ci", constants.ADMIN)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		_, err = store.Login("ci", "")
+		if err == nil {
+			t.Fatal(name, "service account could log in")
+		}
+		account, err := store.UserFromUsername("ci")
+		if err != nil || !account.IsServiceAccount() {
+			t.Fatal(name, "service account not found", err)
+		}
+
+		key, err := account.CreateAPIKey("deploy", constants.USER, time.Time{})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		user, err := store.UserFromID(key)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if user.Username() != "ci" || user.Session() != key || !user.CheckAccess(constants.USER) {
+			t.Fatal(name, "API key did not authenticate the service account")
+		}
+		if user.CheckAccess(constants.ADMIN) {
+			t.Fatal(name, "API key exceeded its access ceiling")
+		}
+		broken := key[:len(key)-1] + "x"
+		if strings.HasSuffix(key, "x") {
+			broken = key[:len(key)-1] + "y"
+		}
+		_, err = store.UserFromID(broken)
+		if !errors.Is(err, constants.ErrNotFound) {
+			t.Fatal(name, "API key with a broken checksum was looked up", err)
+		}
+		_, err = user.CreateAPIKey("escalate", constants.ADMIN, time.Time{})
+		if !errors.Is(err, constants.ErrNotAllowed) {
+			t.Fatal(name, "API key minted a key above its ceiling", err)
+		}
+		keys, err := account.APIKeys()
+		if err != nil || len(keys) != 1 || keys[0].Name != "deploy" || keys[0].LastUsed.IsZero() {
+			t.Fatal(name, "unexpected key listing", keys, err)
+		}
+
+		short, _ := account.CreateAPIKey("short", constants.USER, time.Now().Add(100*time.Millisecond))
+		time.Sleep(150 * time.Millisecond)
+		_, err = store.UserFromID(short)
+		if !errors.Is(err, constants.ErrSessionExpired) {
+			t.Fatal(name, "expired API key was accepted", err)
+		}
+
+		err = account.RevokeAPIKey(keys[0].ID)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		_, err = store.UserFromID(key)
+		if err == nil {
+			t.Fatal(name, "revoked API key was accepted")
+		}
+
+		store.Add("user", "test", constants.USER)
+		human, _ := store.Login("user", "test")
+		_, err = human.CreateAPIKey("admin", constants.ADMIN, time.Time{})
+		if !errors.Is(err, constants.ErrNotAllowed) {
+			t.Fatal(name, "API key exceeded the owner's access", err)
+		}
+		_, err = human.CreateAPIKey("script", constants.USER, time.Time{})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		human.LogOut()
+		_, err = human.CreateAPIKey("script", constants.USER, time.Time{})
+		if !errors.Is(err, constants.ErrNotAllowed) {
+			t.Fatal(name, "API key created without a session", err)
+		}
+		store.Close()
+	}
+}
+
+func TestPersistentAPIKeys(t *testing.T) {
+	database := persistent.WithDatabase(filepath.Join(t.TempDir(), "goauthy.sqlite3"))
+	store, err := persistent.Init(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.AddServiceAccount("ci", constants.USER)
+	account, _ := store.UserFromUsername("ci")
+	key, err := account.CreateAPIKey("deploy", constants.USER, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.UserFromID(key)
+	store.Close()
+
+	store, err = persistent.Init(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	user, err := store.UserFromID(key)
+	if err != nil || !user.CheckAccess(constants.USER) || !user.IsServiceAccount() {
+		t.Fatal("API key did not survive a restart", err)
+	}
+	keys, _ := store.UserFromUsername("ci")
+	listed, _ := keys.APIKeys()
+	if len(listed) != 1 || listed[0].Expires.IsZero() || listed[0].LastUsed.IsZero() {
+		t.Fatal("unexpected key listing", listed)
+	}
+}
+
+func TestAPIKeyCeilings(t *testing.T) {
+	for name, store := range testStores(t, nil, nil) {
+		store.Add("admin", "test", constants.ADMIN)
+		admin, _ := store.Login("admin", "test")
+		key, err := admin.CreateAPIKey("reports", constants.USER, time.Time{})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		restricted, _ := store.UserFromID(key)
+		store.UserFromID(admin.Session())
+		if restricted.CheckAccess(constants.ADMIN) {
+			t.Fatal(name, "looking up the owner's session lifted the key's ceiling")
+		}
+
+		store.AddServiceAccount("ci", constants.ADMIN)
+		account, _ := store.UserFromUsername("ci")
+		low, _ := account.CreateAPIKey("low", constants.USER, time.Time{})
+		account.CreateAPIKey("high", constants.ADMIN, time.Time{})
+		user, _ := store.UserFromID(low)
+		keys, err := user.APIKeys()
+		if err != nil || len(keys) != 1 || keys[0].Name != "low" {
+			t.Fatal(name, "key listed keys above its ceiling", keys, err)
+		}
+		keys, _ = account.APIKeys()
+		for _, listed := range keys {
+			if listed.Name == "high" && user.RevokeAPIKey(listed.ID) == nil {
+				t.Fatal(name, "key revoked a key above its ceiling")
+			}
+		}
+
+		for _, listed := range keys {
+			if listed.Name == "low" {
+				err = account.RevokeAPIKey(listed.ID)
+				if err != nil {
+					t.Fatal(name, err)
+				}
+			}
+		}
+		_, err = user.CreateAPIKey("escalated", constants.ADMIN, time.Time{})
+		if err == nil {
+			t.Fatal(name, "handle of a revoked key created a key")
+		}
+		_, err = user.APIKeys()
+		if err == nil {
+			t.Fatal(name, "handle of a revoked key listed keys")
+		}
+
+		store.Add("demoted", "test", constants.ADMIN)
+		demoted, _ := store.Login("demoted", "test")
+		demoted.CreateAPIKey("old", constants.ADMIN, time.Time{})
+		demoted.CreatePersonalToken("old", []string{"read:profile"}, time.Time{})
+		err = demoted.ChangeAccess(constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		keys, err = demoted.APIKeys()
+		if err != nil || len(keys) != 1 || keys[0].Access != constants.USER {
+			t.Fatal(name, "key of a demoted user was not lowered to the new access", keys, err)
+		}
+		err = demoted.RevokeAPIKey(keys[0].ID)
+		if err != nil {
+			t.Fatal(name, "demoted user could not revoke their key", err)
+		}
+		personalTokens, _ := demoted.PersonalTokens()
+		if len(personalTokens) != 1 || demoted.RevokePersonalToken(personalTokens[0].ID) != nil {
+			t.Fatal(name, "demoted user could not revoke their personal access token", personalTokens)
+		}
+		store.Close()
+	}
+}
@@ -0,0 +1,97 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/auth"
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/detector"
+	"github.com/Varppi/goauthy/pkg/hasher"
+	"github.com/Varppi/goauthy/pkg/memory"
+	"github.com/Varppi/goauthy/pkg/persistent"
+)
+
+func TestCredentialStuffing(t *testing.T) {
+	var lock sync.Mutex
+	var events []detector.Event
+	newDetector := func() *detector.Detector {
+		return detector.New(detector.Settings{
+			Window:         time.Second,
+			ChallengeAfter: 3,
+			BlockAfter:     5,
+			OnEvent: func(event detector.Event) {
+				lock.Lock()
+				defer lock.Unlock()
+				events = append(events, event)
+			},
+		})
+	}
+	stores := testStores(t,
+		[]memory.Option{memory.WithDetector(newDetector()), memory.WithPasswordHasher(hasher.NewBcrypt(4))},
+		[]persistent.Option{persistent.WithDetector(newDetector()), persistent.WithPasswordHasher(hasher.NewBcrypt(4))},
+	)
+	for name, store := range stores {
+		events = nil
+		err := store.Add("user", "test", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		attacker := auth.Client{IP: "203.0.113.7"}
+
+		for i := range 3 {
+			store.LoginWithClient(fmt.Sprintf("victim%d", i), "Summer2024!", attacker)
+		}
+		_, err = store.LoginWithClient("user", "test", attacker)
+		if !errors.Is(err, constants.ErrChallengeRequired) {
+			t.Fatal(name, "spraying source was not challenged", err)
+		}
+		attacker.ChallengeSolved = true
+		user, err := store.LoginWithClient("user", "test", attacker)
+		if err != nil {
+			t.Fatal(name, "solved challenge was not accepted", err)
+		}
+		user.LogOut()
+
+		for i := 3; i < 5; i++ {
+			store.LoginWithClient(fmt.Sprintf("victim%d", i), "Summer2024!", attacker)
+		}
+		_, err = store.LoginWithClient("user", "test", attacker)
+		if !errors.Is(err, constants.ErrSourceBlocked) {
+			t.Fatal(name, "spraying source was not blocked", err)
+		}
+		user, err = store.LoginWithClient("user", "test", auth.Client{IP: "198.51.100.1"})
+		if err != nil {
+			t.Fatal(name, "other sources were affected", err)
+		}
+		user.LogOut()
+
+		lock.Lock()
+		if len(events) != 2 || events[0].Verdict != detector.Challenge || events[1].Verdict != detector.Block {
+			t.Fatal(name, "unexpected events", events)
+		}
+		if events[1].Source != attacker.IP || len(events[1].Accounts) != 5 {
+			t.Fatal(name, "event does not describe the source", events[1])
+		}
+		lock.Unlock()
+
+		time.Sleep(1100 * time.Millisecond)
+		user, err = store.LoginWithClient("user", "test", auth.Client{IP: attacker.IP})
+		if err != nil {
+			t.Fatal(name, "source stayed blocked after the window", err)
+		}
+		user.LogOut()
+		store.Close()
+	}
+
+	// stores without a detector hold a nil one
+	var none *detector.Detector
+	none.Failure("203.0.113.7", "user")
+	none.Reset("203.0.113.7")
+	if none.Check("203.0.113.7") != detector.Allow {
+		t.Fatal("nil detector did not allow")
+	}
+}
@@ -0,0 +1,165 @@
+package test
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/mailer"
+	"github.com/Varppi/goauthy/pkg/memory"
+	"github.com/Varppi/goauthy/pkg/persistent"
+)
+
+// Pulls the token out of a link mailed by the store
+func mailedToken(t *testing.T, outbox *mailer.Memory, to string) string {
+	message, ok := outbox.Last(to)
+	if !ok {
+		t.Fatal("nothing was mailed to", to)
+	}
+	link, err := url.Parse(message.Body[strings.Index(message.Body, "https://"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link.Query().Get("token")
+}
+
+func TestEmailVerification(t *testing.T) {
+	outbox := mailer.NewMemory()
+	stores := testStores(t,
+		[]memory.Option{
+			memory.WithMailer(outbox, "https://example.com/auth/"),
+			memory.WithUserSettings(&memory.UserSettings{RequireVerifiedEmail: true, EmailVerificationTTL: 300 * time.Millisecond}),
+		},
+		[]persistent.Option{
+			persistent.WithMailer(outbox, "https://example.com/auth/"),
+			persistent.WithUserSettings(&persistent.UserSettings{RequireVerifiedEmail: true, EmailVerificationTTL: 300 * time.Millisecond}),
+		},
+	)
+	for name, store := range stores {
+		err := store.Add("user", "test", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		store.Add("other", "test", constants.USER)
+		user, _ := store.UserFromUsername("user")
+		other, _ := store.UserFromUsername("other")
+
+		if !errors.Is(user.SetEmail("Someone <user@example.com>"), constants.ErrInvalidEmail) {
+			t.Fatal(name, "address with a display name was accepted")
+		}
+		err = user.SetEmail("user@example.com")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !errors.Is(other.SetEmail("USER@example.com"), constants.ErrAlreadyExists) {
+			t.Fatal(name, "email address could be taken twice")
+		}
+		_, err = store.Login("user", "test")
+		if !errors.Is(err, constants.ErrEmailNotVerified) {
+			t.Fatal(name, "unverified user could log in", err)
+		}
+
+		err = user.SendEmailVerification()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		message, _ := outbox.Last("user@example.com")
+		if !strings.Contains(message.Body, "https://example.com/auth/verify-email?token=") {
+			t.Fatal(name, "message does not link to the verification page", message.Body)
+		}
+		token := mailedToken(t, outbox, "user@example.com")
+		if !errors.Is(store.VerifyEmail(token[:len(token)-2]+"AA"), constants.ErrInvalidToken) {
+			t.Fatal(name, "tampered token was accepted")
+		}
+		err = store.VerifyEmail(token)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !errors.Is(store.VerifyEmail(token), constants.ErrInvalidToken) {
+			t.Fatal(name, "verification token could be used twice")
+		}
+		session, err := store.Login("user", "test")
+		if err != nil || !user.EmailVerified() {
+			t.Fatal(name, "verified user could not log in", err)
+		}
+		session.LogOut()
+		if !errors.Is(session.SetEmail("attacker@example.com"), constants.ErrNotAllowed) || !errors.Is(session.SendEmailVerification(), constants.ErrNotAllowed) {
+			t.Fatal(name, "email address was managed without a session")
+		}
+
+		// a token for a replaced address or past its lifetime is worthless
+		user.SendEmailVerification()
+		token = mailedToken(t, outbox, "user@example.com")
+		user.SetEmail("new@example.com")
+		if !errors.Is(store.VerifyEmail(token), constants.ErrInvalidToken) || user.EmailVerified() {
+			t.Fatal(name, "token for the old address verified the new one")
+		}
+		user.SetEmail("user@example.com")
+		if !errors.Is(store.VerifyEmail(token), constants.ErrInvalidToken) || user.EmailVerified() {
+			t.Fatal(name, "token survived setting its address again")
+		}
+		user.SetEmail("new@example.com")
+		user.SendEmailVerification()
+		token = mailedToken(t, outbox, "new@example.com")
+		time.Sleep(350 * time.Millisecond)
+		if !errors.Is(store.VerifyEmail(token), constants.ErrInvalidToken) {
+			t.Fatal(name, "expired token was accepted")
+		}
+		store.Close()
+	}
+}
+
+func TestPersistentSigningKey(t *testing.T) {
+	outbox := mailer.NewMemory()
+	options := []persistent.Option{
+		persistent.WithDatabase(filepath.Join(t.TempDir(), "goauthy.sqlite3")),
+		persistent.WithMailer(outbox, "https://example.com/auth/"),
+	}
+	store, err := persistent.Init(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add("user", "test", constants.USER)
+	user, _ := store.UserFromUsername("user")
+	user.SetEmail("user@example.com")
+	err = user.SendEmailVerification()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = persistent.Init(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	err = store.VerifyEmail(mailedToken(t, outbox, "user@example.com"))
+	if err != nil {
+		t.Fatal("token did not survive a restart", err)
+	}
+}
+
+func TestDirectoryMailer(t *testing.T) {
+	path := t.TempDir()
+	directory, err := mailer.NewDirectory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = directory.Send(mailer.Message{To: "user@example.com", Subject: "Hello", Body: "World"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := os.ReadDir(path)
+	if len(files) != 1 {
+		t.Fatal("message was not written")
+	}
+	content, _ := os.ReadFile(path + "/" + files[0].Name())
+	if !strings.Contains(string(content), "Subject: Hello\r\n\r\nWorld") {
+		t.Fatal("unexpected message file", string(content))
+	}
+}
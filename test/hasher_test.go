@@ -0,0 +1,223 @@
+package test
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/hasher"
+	"github.com/Varppi/goauthy/pkg/memory"
+	"github.com/Varppi/goauthy/pkg/persistent"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := map[string]hasher.PasswordHasher{
+		"bcrypt":   hasher.NewBcrypt(4),
+		"argon2id": &hasher.Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		"scrypt":   &hasher.Scrypt{LogN: 10, R: 8, P: 1, SaltLength: 16, KeyLength: 32},
+	}
+	for name, passwordHasher := range hashers {
+		encoded, err := passwordHasher.Hash("test")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		ok, err := hasher.Verify("test", encoded)
+		if err != nil || !ok {
+			t.Fatal(name, "could not verify correct password", err)
+		}
+
+		ok, err = hasher.Verify("wrong", encoded)
+		if err != nil || ok {
+			t.Fatal(name, "verified wrong password", err)
+		}
+
+		if passwordHasher.NeedsRehash(encoded) {
+			t.Fatal(name, "fresh hash needs rehash")
+		}
+
+		for otherName, other := range hashers {
+			if otherName != name && !other.NeedsRehash(encoded) {
+				t.Fatal(otherName, "does not want to replace", name)
+			}
+		}
+	}
+
+	if !hasher.NewBcrypt(4).NeedsRehash(mustHash(t, hasher.NewBcrypt(5), "test")) {
+		t.Fatal("bcrypt cost change does not trigger rehash")
+	}
+
+	_, err := hasher.Verify("test", "plaintext")
+	if err == nil {
+		t.Fatal("could verify against unknown hash format")
+	}
+
+	for _, params := range []string{"m=1024,t=0,p=1", "m=1024,t=1,p=0", "m=4294967295,t=1,p=1"} {
+		_, err = hasher.Verify("test", "$argon2id$v=19$"+params+"$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaA")
+		if !errors.Is(err, hasher.ErrMalformedHash) {
+			t.Fatal(params, "argon2id parameters were accepted", err)
+		}
+	}
+
+	for _, params := range []string{"ln=15,r=0,p=1", "ln=15,r=8,p=0", "ln=10,r=1073741824,p=1", "ln=31,r=8,p=1"} {
+		_, err = hasher.Verify("test", "$scrypt$"+params+"$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaA")
+		if !errors.Is(err, hasher.ErrMalformedHash) {
+			t.Fatal(params, "scrypt parameters were accepted", err)
+		}
+	}
+
+	for name, store := range testStores(t, nil, nil) {
+		err := store.Import("malformed", "$scrypt$ln=15,r=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaA", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		_, err = store.Login("malformed", "test")
+		if err == nil {
+			t.Fatal(name, "could login against a malformed scrypt hash")
+		}
+		store.Close()
+	}
+
+	invalid := []hasher.PasswordHasher{
+		&hasher.Argon2id{},
+		&hasher.Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1},
+		&hasher.Scrypt{},
+		&hasher.Scrypt{LogN: 10, R: 8, P: 1},
+		&hasher.Scrypt{LogN: 24, R: 8, P: 1, SaltLength: 16, KeyLength: 32},
+	}
+	for _, passwordHasher := range invalid {
+		_, err = memory.Init(memory.WithPasswordHasher(passwordHasher))
+		if !errors.Is(err, constants.ErrInvalidOption) {
+			t.Fatal("invalid hasher was accepted", passwordHasher, err)
+		}
+		_, err = persistent.Init(persistent.WithPasswordHasher(passwordHasher))
+		if !errors.Is(err, constants.ErrInvalidOption) {
+			t.Fatal("invalid hasher was accepted", passwordHasher, err)
+		}
+	}
+
+	_, err = memory.Init(memory.WithPasswordHasher(hasher.NewBcrypt(bcrypt.MaxCost + 1)))
+	if !errors.Is(err, constants.ErrInvalidOption) {
+		t.Fatal("bcrypt cost above the maximum was accepted", err)
+	}
+	_, err = persistent.Init(persistent.WithPasswordHasher(hasher.NewBcrypt(1)))
+	if !errors.Is(err, constants.ErrInvalidOption) {
+		t.Fatal("bcrypt cost below the minimum was accepted", err)
+	}
+}
+
+func TestRehashOnLogin(t *testing.T) {
+	database := filepath.Join(t.TempDir(), "goauthy.sqlite3")
+	logger := persistent.WithLogger(log.New(io.Discard, "", 0))
+	store, err := persistent.Init(persistent.WithDatabase(database), logger, persistent.WithPasswordHasher(hasher.NewBcrypt(4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Add("user", "test", constants.USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	argon2id := &hasher.Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	store, err = persistent.Init(persistent.WithDatabase(database), logger, persistent.WithPasswordHasher(argon2id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Login("user", "wrong")
+	if err == nil {
+		t.Fatal("could login with wrong password")
+	}
+	_, err = store.Login("user", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	if !strings.HasPrefix(storedPassword(t, database, "user"), "$argon2id$") {
+		t.Fatal("password was not rehashed with the primary hasher")
+	}
+}
+
+func mustHash(t *testing.T, passwordHasher hasher.PasswordHasher, password string) string {
+	encoded, err := passwordHasher.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func storedPassword(t *testing.T, database, username string) string {
+	db, err := sql.Open("sqlite3", database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var password string
+	err = db.QueryRow(`SELECT password FROM users WHERE username=?`, username).Scan(&password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return password
+}
+
+var legacyHashes = []string{
+	"pbkdf2_sha256$260000$seasalt$ftMWvEdczZQK5azuap2CQYKRjHLa1wOuMrfMiYEswYQ=",
+	"$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1",
+	"$1$abcdefgh$G//4keteveJp0qb8z2DxG/",
+	"$5$saltstring$OH4IDuTlsuTYPdED1gsuiRMyTAwNlRWyA6Xr3I4/dQ5",
+	"$6$saltstring$adDbXsJjcDlq2662QPgd.tkSOVmnG9Tt3oXl4HR60SusC3AGjirnDenVZp3DGwLwqy6iYKCzannhaX9DR72nN1",
+	"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+	"{SSHA}rXVtWiPAY6/w8MuTLKIjpBjj2mtzYWx0MTIzNA==",
+	"{SSHA256}ZqbcWj6+KqD5BBm617QPtrpLWEgXUSAWm8MErrSqRq5zYWx0MTIzNA==",
+	"{SSHA512}nOkBUt6l7zlKAfjtk1EfB0TmckXfDiA4FPLcpywOLORZ1PWQK4+PZVEiT4+9rFjqR3xnaruZBiRjDGcDpxxTinNhbHQxMjM0",
+}
+
+func TestLegacyHashes(t *testing.T) {
+	for _, encoded := range legacyHashes {
+		ok, err := hasher.Verify("password", encoded)
+		if err != nil || !ok {
+			t.Fatal(encoded, "could not verify correct password", err)
+		}
+		ok, err = hasher.Verify("wrong", encoded)
+		if err != nil || ok {
+			t.Fatal(encoded, "verified wrong password", err)
+		}
+	}
+
+	ok, err := hasher.Verify("Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.")
+	if err != nil || !ok {
+		t.Fatal("could not verify sha512-crypt with custom rounds", err)
+	}
+
+	for name, store := range testStores(t, nil, nil) {
+		err := store.Import("legacy", "plaintext", constants.USER)
+		if err == nil {
+			t.Fatal(name, "could import unknown hash format")
+		}
+		for index, encoded := range legacyHashes {
+			username := "legacy" + string(rune('a'+index))
+			err := store.Import(username, encoded, constants.USER)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			_, err = store.Login(username, "wrong")
+			if err == nil {
+				t.Fatal(name, encoded, "could login with wrong password")
+			}
+			for range 2 { // the second login uses the upgraded hash
+				_, err = store.Login(username, "password")
+				if err != nil {
+					t.Fatal(name, encoded, err)
+				}
+			}
+		}
+		store.Close()
+	}
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/hasher"
+	"github.com/Varppi/goauthy/pkg/memory"
+	"github.com/Varppi/goauthy/pkg/persistent"
+)
+
+func TestAccountLockout(t *testing.T) {
+	stores := testStores(t,
+		[]memory.Option{
+			memory.WithPasswordHasher(hasher.NewBcrypt(4)),
+			memory.WithUserSettings(&memory.UserSettings{LockoutThreshold: 3, LockoutDuration: 200 * time.Millisecond, LockoutBackoff: true, LockoutDecay: time.Second}),
+		},
+		[]persistent.Option{
+			persistent.WithPasswordHasher(hasher.NewBcrypt(4)),
+			persistent.WithUserSettings(&persistent.UserSettings{LockoutThreshold: 3, LockoutDuration: 200 * time.Millisecond, LockoutBackoff: true, LockoutDecay: time.Second}),
+		},
+	)
+	for name, store := range stores {
+		err := store.Add("user", "test", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		for range 3 {
+			_, err = store.Login("user", "wrong")
+			if !errors.Is(err, constants.ErrInvalidCredentials) {
+				t.Fatal(name, "wrong password was not rejected", err)
+			}
+		}
+		_, err = store.Login("user", "test")
+		if !errors.Is(err, constants.ErrAccountLocked) {
+			t.Fatal(name, "account was not locked", err)
+		}
+		locked := store.LockedUsers()
+		if len(locked) != 1 || locked[0] != "user" {
+			t.Fatal(name, "locked account is not listed", locked)
+		}
+
+		time.Sleep(250 * time.Millisecond)
+		user, err := store.Login("user", "test")
+		if err != nil {
+			t.Fatal(name, "account stayed locked", err)
+		}
+		user.LogOut()
+		for range 3 {
+			store.Login("user", "wrong")
+		}
+		status, err := store.LockoutStatus("user")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if status.Lockouts != 2 || time.Until(status.LockedUntil) < 300*time.Millisecond {
+			t.Fatal(name, "a successful login reset the backoff", status)
+		}
+
+		// the backoff starts over once the decay passed after the lockout ended
+		time.Sleep(time.Until(status.LockedUntil) + 1100*time.Millisecond)
+		for range 3 {
+			store.Login("user", "wrong")
+		}
+		status, _ = store.LockoutStatus("user")
+		if status.Lockouts != 1 {
+			t.Fatal(name, "lockouts did not decay", status)
+		}
+
+		err = store.Unlock("user")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		_, err = store.Login("user", "test")
+		if err != nil {
+			t.Fatal(name, "unlocked account could not log in", err)
+		}
+		status, _ = store.LockoutStatus("user")
+		if status.Locked() || status.FailedAttempts != 0 || status.Lockouts != 0 {
+			t.Fatal(name, "lockout was not cleared", status)
+		}
+		store.Close()
+	}
+}
+
+func TestPersistentLockout(t *testing.T) {
+	database := filepath.Join(t.TempDir(), "goauthy.sqlite3")
+	options := []persistent.Option{
+		persistent.WithDatabase(database),
+		persistent.WithLogger(log.New(io.Discard, "", 0)),
+		persistent.WithUserSettings(&persistent.UserSettings{LockoutThreshold: 2, LockoutDuration: time.Hour}),
+	}
+	store, err := persistent.Init(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Add("user", "test", constants.USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Login("user", "wrong")
+	store.Login("user", "wrong")
+	store.Close()
+
+	store, err = persistent.Init(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	_, err = store.Login("user", "test")
+	if !errors.Is(err, constants.ErrAccountLocked) {
+		t.Fatal("lockout did not survive a restart", err)
+	}
+}
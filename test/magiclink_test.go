@@ -0,0 +1,124 @@
+package test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/auth"
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/detector"
+	"github.com/Varppi/goauthy/pkg/mailer"
+	"github.com/Varppi/goauthy/pkg/memory"
+	"github.com/Varppi/goauthy/pkg/notifier"
+	"github.com/Varppi/goauthy/pkg/persistent"
+)
+
+func TestMagicLinks(t *testing.T) {
+	outbox := &testNotifier{}
+	mails := mailer.NewMemory()
+	stores := testStores(t,
+		[]memory.Option{
+			memory.WithNotifier(outbox),
+			memory.WithMailer(mails, "https://example.com/auth"),
+			memory.WithUserSettings(&memory.UserSettings{MagicLinkTTL: 300 * time.Millisecond}),
+			memory.WithDetector(detector.New(detector.Settings{ChallengeAfter: 3})),
+		},
+		[]persistent.Option{
+			persistent.WithNotifier(outbox),
+			persistent.WithMailer(mails, "https://example.com/auth"),
+			persistent.WithUserSettings(&persistent.UserSettings{MagicLinkTTL: 300 * time.Millisecond}),
+			persistent.WithDetector(detector.New(detector.Settings{ChallengeAfter: 3})),
+		},
+	)
+	for name, store := range stores {
+		outbox.notifications = nil
+		err := store.Add("user", "test", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		account, _ := store.UserFromUsername("user")
+		account.SetEmail("user@example.com")
+		store.RequestMagicLink("user", false)
+		if len(outbox.notifications) != 0 {
+			t.Fatal(name, "login link was sent to an unverified address")
+		}
+		account.SendEmailVerification()
+		err = store.VerifyEmail(mailedToken(t, mails, "user@example.com"))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		nonce, err := store.RequestMagicLink("user", false)
+		if err != nil || nonce != "" {
+			t.Fatal(name, "unbound link came with a nonce", err)
+		}
+		notification := outbox.last()
+		if notification.Kind != notifier.MagicLink || notification.Username != "user" {
+			t.Fatal(name, "unexpected notification", notification)
+		}
+		user, err := store.LoginWithMagicLink(notification.Token, "", auth.Client{})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !user.CheckAccess(constants.USER) {
+			t.Fatal(name, "login link did not create a session")
+		}
+		_, err = store.LoginWithMagicLink(notification.Token, "", auth.Client{})
+		if !errors.Is(err, constants.ErrInvalidToken) {
+			t.Fatal(name, "login link could be used twice", err)
+		}
+
+		nonce, err = store.RequestMagicLink("user", true)
+		if err != nil || nonce == "" {
+			t.Fatal(name, "bound link came without a nonce", err)
+		}
+		_, err = store.LoginWithMagicLink(outbox.last().Token, "another browser", auth.Client{})
+		if !errors.Is(err, constants.ErrInvalidToken) {
+			t.Fatal(name, "link bound to a browser worked in another one", err)
+		}
+		nonce, _ = store.RequestMagicLink("user", true)
+		_, err = store.LoginWithMagicLink(outbox.last().Token, nonce, auth.Client{})
+		if err != nil {
+			t.Fatal(name, "link did not work in the browser it was bound to", err)
+		}
+
+		store.RequestMagicLink("user", false)
+		time.Sleep(350 * time.Millisecond)
+		_, err = store.LoginWithMagicLink(outbox.last().Token, "", auth.Client{})
+		if !errors.Is(err, constants.ErrInvalidToken) {
+			t.Fatal(name, "expired login link was accepted", err)
+		}
+
+		guesser := auth.Client{IP: "192.0.2.1"}
+		for _, guess := range []string{"gml_first", "gml_second", "gml_third"} {
+			store.LoginWithMagicLink(guess, "", guesser)
+		}
+		_, err = store.LoginWithMagicLink("gml_fourth", "", guesser)
+		if !errors.Is(err, constants.ErrChallengeRequired) {
+			t.Fatal(name, "guessing login links did not escalate", err)
+		}
+
+		store.RequestMagicLink("user", false)
+		moved := outbox.last().Token
+		account.SetEmail("moved@example.com")
+		_, err = store.LoginWithMagicLink(moved, "", auth.Client{})
+		if !errors.Is(err, constants.ErrInvalidToken) {
+			t.Fatal(name, "login link survived an email change", err)
+		}
+		account.SendEmailVerification()
+		store.VerifyEmail(mailedToken(t, mails, "moved@example.com"))
+		store.RequestMagicLink("user", false)
+		deleted := outbox.last().Token
+		err = account.Delete()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		store.Add("user", "test", constants.USER)
+		_, err = store.LoginWithMagicLink(deleted, "", auth.Client{})
+		if !errors.Is(err, constants.ErrInvalidToken) {
+			t.Fatal(name, "login link of a deleted user logged into the recreated one", err)
+		}
+		store.Close()
+	}
+}
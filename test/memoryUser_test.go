@@ -10,10 +10,13 @@ import (
 )
 
 func TestInMemoryFeatures(t *testing.T) {
-	//store := memory.Init()
-	store := memory.Init(log.New(io.Discard, "", 0))
+	//store, err := memory.Init()
+	store, err := memory.Init(memory.WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	err := store.Add("user", "test", constants.USER)
+	err = store.Add("user", "test", constants.USER)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,7 +56,28 @@ func TestInMemoryFeatures(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	user.Variables["test"] = "hello"
+	err = user.SetVariable("test", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = user.SetVariable("test", struct{}{})
+	if err == nil {
+		t.Fatal("could set variable of unsupported type")
+	}
+
+	labels := map[string]string{"team": "auth"}
+	err = user.SetVariable("labels", labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels["team"] = "changed"
+	stored, _ := user.GetVariable("labels")
+	stored.(map[string]string)["team"] = "changed"
+	stored, _ = user.GetVariable("labels")
+	if stored.(map[string]string)["team"] != "auth" {
+		t.Fatal("variable shares its map with callers")
+	}
 
 	user.LogOutFully()
 	err = user.ChangePassword("test2")
@@ -61,7 +85,10 @@ func TestInMemoryFeatures(t *testing.T) {
 		t.Fatal("could change password without valid session")
 	}
 
-	store2 := memory.Init(nil, &memory.UserSettings{AllowPasswordChange: false})
+	store2, err := memory.Init(memory.WithUserSettings(&memory.UserSettings{AllowPasswordChange: false}))
+	if err != nil {
+		t.Fatal(err)
+	}
 	err = store2.Add("test", "test", constants.PUBLIC)
 	if err != nil {
 		t.Fatal(err)
@@ -76,4 +103,14 @@ func TestInMemoryFeatures(t *testing.T) {
 	if err == nil {
 		t.Fatal("could change password even though password changing is disabled")
 	}
+
+	_, err = memory.Init(memory.WithUsernamePattern("[a-z"))
+	if err == nil {
+		t.Fatal("could init store with invalid username pattern")
+	}
+
+	_, err = memory.Init(memory.WithLogger(nil))
+	if err == nil {
+		t.Fatal("could init store with nil logger")
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/Varppi/goauthy/pkg/constants"
@@ -12,7 +13,7 @@ import (
 
 func TestPersistentFeatures(t *testing.T) {
 	//store := memory.Init()
-	store, err := persistent.Init(nil, log.New(io.Discard, "", 0))
+	store, err := persistent.Init(persistent.WithLogger(log.New(io.Discard, "", 0)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -56,7 +57,28 @@ func TestPersistentFeatures(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	user.Variables["test"] = "hello"
+	err = user.SetVariable("test", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = user.SetVariable("test", struct{}{})
+	if err == nil {
+		t.Fatal("could set variable of unsupported type")
+	}
+
+	labels := map[string]string{"team": "auth"}
+	err = user.SetVariable("labels", labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels["team"] = "changed"
+	stored, _ := user.GetVariable("labels")
+	stored.(map[string]string)["team"] = "changed"
+	stored, _ = user.GetVariable("labels")
+	if stored.(map[string]string)["team"] != "auth" {
+		t.Fatal("variable shares its map with callers")
+	}
 
 	user.LogOutFully()
 	err = user.ChangePassword("test2")
@@ -64,7 +86,7 @@ func TestPersistentFeatures(t *testing.T) {
 		t.Fatal("could change password without valid session")
 	}
 
-	store2, err := persistent.Init(nil, nil, &persistent.UserSettings{AllowPasswordChange: false})
+	store2, err := persistent.Init(persistent.WithUserSettings(&persistent.UserSettings{AllowPasswordChange: false}))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -91,3 +113,75 @@ func TestPersistentFeatures(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestPersistentSessions(t *testing.T) {
+	database := filepath.Join(t.TempDir(), "goauthy.sqlite3")
+	store, err := persistent.Init(persistent.WithDatabase(database), persistent.WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Add("user", "test", constants.USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.Login("user", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := user.Session()
+	err = user.SetVariable("tenant", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.ChangePassword("test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.ChangeAccess(constants.ADMIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = persistent.Init(persistent.WithDatabase(database), persistent.WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = store.UserFromID(session)
+	if err != nil {
+		t.Fatal("session did not survive a restart")
+	}
+	if !user.CheckAccess(constants.ADMIN) {
+		t.Fatal("restored session is not valid or access change was not persisted")
+	}
+	tenant, ok := user.GetVariable("tenant")
+	if !ok || tenant != 42 {
+		t.Fatal("variable did not survive a restart")
+	}
+
+	user.LogOut()
+	store.Close()
+
+	store, err = persistent.Init(persistent.WithDatabase(database), persistent.WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	_, err = store.UserFromID(session)
+	if err == nil {
+		t.Fatal("logged out session came back after a restart")
+	}
+
+	user, err = store.Login("user", "test1")
+	if err != nil {
+		t.Fatal("password change was not persisted")
+	}
+	err = user.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.UserFromUsername("user")
+	if err == nil {
+		t.Fatal("deleted user still exists")
+	}
+}
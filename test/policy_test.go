@@ -0,0 +1,240 @@
+package test
+
+import (
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/hasher"
+	"github.com/Varppi/goauthy/pkg/memory"
+	"github.com/Varppi/goauthy/pkg/persistent"
+	"github.com/Varppi/goauthy/pkg/policy"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	passwordPolicy := policy.New(
+		policy.MinLength(10),
+		policy.MaxLength(64),
+		policy.Uppercase(1),
+		policy.Digits(2),
+		policy.Symbols(1),
+		policy.NotContainingUsername(),
+	)
+
+	err := passwordPolicy.Check("user", "user")
+	policyErr := &policy.Error{}
+	if !errors.As(err, &policyErr) || !errors.Is(err, constants.ErrPasswordPolicy) {
+		t.Fatal("policy did not return a policy error", err)
+	}
+	rules := map[string]bool{}
+	for _, violation := range policyErr.Violations {
+		rules[violation.Rule] = true
+	}
+	for _, rule := range []string{"min_length", "uppercase", "digits", "symbols", "username"} {
+		if !rules[rule] {
+			t.Fatal("violation not reported:", rule)
+		}
+	}
+	if rules["max_length"] {
+		t.Fatal("reported a rule that was not violated")
+	}
+
+	err = passwordPolicy.Check("user", "Correct-Horse-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := testStores(t,
+		[]memory.Option{memory.WithPasswordPolicy(passwordPolicy)},
+		[]persistent.Option{persistent.WithPasswordPolicy(passwordPolicy)},
+	)
+	for name, store := range stores {
+		err := store.Add("user", "short", constants.USER)
+		if !errors.Is(err, constants.ErrPasswordPolicy) {
+			t.Fatal(name, "could add user with password breaking the policy")
+		}
+
+		err = store.Add("user", "Correct-Horse-42", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		user, err := store.Login("user", "Correct-Horse-42")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		err = user.ChangePassword("Myuser-name-42")
+		if !errors.Is(err, constants.ErrPasswordPolicy) {
+			t.Fatal(name, "could change password to one breaking the policy")
+		}
+		store.Close()
+	}
+}
+
+func TestPasswordHistory(t *testing.T) {
+	stores := testStores(t,
+		[]memory.Option{
+			memory.WithPasswordHasher(hasher.NewBcrypt(4)),
+			memory.WithUserSettings(&memory.UserSettings{AllowPasswordChange: true, PasswordHistory: 3}),
+		},
+		[]persistent.Option{
+			persistent.WithPasswordHasher(hasher.NewBcrypt(4)),
+			persistent.WithUserSettings(&persistent.UserSettings{AllowPasswordChange: true, PasswordHistory: 3}),
+		},
+	)
+	for name, store := range stores {
+		err := store.Add("user", "first", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		user, err := store.Login("user", "first")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		err = user.ChangePassword("first")
+		if !errors.Is(err, constants.ErrPasswordReused) {
+			t.Fatal(name, "could reuse the current password")
+		}
+		for _, password := range []string{"second", "third"} {
+			err = user.ChangePassword(password)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+		}
+		err = user.ChangePassword("first")
+		if !errors.Is(err, constants.ErrPasswordReused) {
+			t.Fatal(name, "could reuse a password from the history")
+		}
+		err = user.ChangePassword("fourth")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		err = user.ChangePassword("first")
+		if err != nil {
+			t.Fatal(name, "password older than the history is still rejected")
+		}
+		store.Close()
+	}
+
+	database := filepath.Join(t.TempDir(), "goauthy.sqlite3")
+	options := []persistent.Option{
+		persistent.WithDatabase(database),
+		persistent.WithLogger(log.New(io.Discard, "", 0)),
+		persistent.WithPasswordHasher(hasher.NewBcrypt(4)),
+		persistent.WithUserSettings(&persistent.UserSettings{AllowPasswordChange: true, PasswordHistory: 3}),
+	}
+	store, err := persistent.Init(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Add("user", "first", constants.USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.Login("user", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.ChangePassword("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = persistent.Init(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = store.Login("user", "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.ChangePassword("first")
+	if !errors.Is(err, constants.ErrPasswordReused) {
+		t.Fatal("password history did not survive a restart")
+	}
+	err = user.ChangePassword("third")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// a shorter history forgets the oldest hashes on the next start
+	options[3] = persistent.WithUserSettings(&persistent.UserSettings{AllowPasswordChange: true, PasswordHistory: 2})
+	store, err = persistent.Init(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	user, err = store.Login("user", "third")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.ChangePassword("first")
+	if err != nil {
+		t.Fatal("password history was not trimmed to the configured length", err)
+	}
+}
+
+func TestPasswordExpiry(t *testing.T) {
+	stores := testStores(t,
+		[]memory.Option{memory.WithUserSettings(&memory.UserSettings{AllowPasswordChange: true, PasswordMaxAge: 200 * time.Millisecond})},
+		[]persistent.Option{persistent.WithUserSettings(&persistent.UserSettings{AllowPasswordChange: true, PasswordMaxAge: 200 * time.Millisecond})},
+	)
+	for name, store := range stores {
+		err := store.Add("user", "temporary", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		admin, err := store.UserFromUsername("user")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		err = admin.RequirePasswordChange()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		user, err := store.Login("user", "temporary")
+		if !errors.Is(err, constants.ErrPasswordChangeRequired) {
+			t.Fatal(name, "login did not require a password change", err)
+		}
+		if user.CheckAccess(constants.USER) {
+			t.Fatal(name, "restricted session could be used")
+		}
+		err = user.ChangePassword("permanent")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !user.CheckAccess(constants.USER) {
+			t.Fatal(name, "session still restricted after changing the password")
+		}
+		err = admin.RequirePasswordChange()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if user.CheckAccess(constants.USER) {
+			t.Fatal(name, "existing session was not restricted by a required change")
+		}
+		err = user.ChangePassword("rotated")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		time.Sleep(250 * time.Millisecond)
+		user, err = store.Login("user", "rotated")
+		if !errors.Is(err, constants.ErrPasswordChangeRequired) {
+			t.Fatal(name, "expired password did not require a change", err)
+		}
+		if time.Since(user.PasswordChangedAt()) < 200*time.Millisecond {
+			t.Fatal(name, "password change time was not recorded")
+		}
+		store.Close()
+	}
+}
@@ -0,0 +1,115 @@
+package test
+
+import (
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/memory"
+	"github.com/Varppi/goauthy/pkg/persistent"
+	"github.com/Varppi/goauthy/pkg/totp"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	stores := testStores(t,
+		[]memory.Option{memory.WithRecoveryCodes(4)},
+		[]persistent.Option{persistent.WithRecoveryCodes(4)},
+	)
+	for name, store := range stores {
+		err := store.Add("user", "test", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		user, err := store.Login("user", "test")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		enrollment, err := user.EnrollTOTP()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		code, _ := totp.Code(enrollment.Secret, totp.Counter(time.Now()))
+		err = user.ConfirmTOTP(code)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		first, err := user.GenerateRecoveryCodes()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		codes, err := user.GenerateRecoveryCodes()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if len(codes) != 4 || user.RecoveryCodesLeft() != 4 {
+			t.Fatal(name, "wrong number of recovery codes", codes)
+		}
+		user.LogOut()
+
+		user, err = store.Login("user", "test")
+		if !errors.Is(err, constants.ErrMFARequired) {
+			t.Fatal(name, err)
+		}
+		if !errors.Is(user.VerifyRecoveryCode(first[0]), constants.ErrInvalidCode) {
+			t.Fatal(name, "regenerated code still works")
+		}
+		// users type codes however they like
+		err = user.VerifyRecoveryCode(strings.ToUpper(strings.ReplaceAll(codes[0], "-", " ")))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !user.CheckAccess(constants.USER) || user.RecoveryCodesLeft() != 3 {
+			t.Fatal(name, "recovery code did not complete the login")
+		}
+		if !errors.Is(user.VerifyRecoveryCode(codes[0]), constants.ErrInvalidCode) {
+			t.Fatal(name, "recovery code could be used twice")
+		}
+		store.Close()
+	}
+}
+
+func TestPersistentRecoveryCodes(t *testing.T) {
+	options := []persistent.Option{
+		persistent.WithDatabase(filepath.Join(t.TempDir(), "goauthy.sqlite3")),
+		persistent.WithLogger(log.New(io.Discard, "", 0)),
+	}
+	store, err := persistent.Init(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add("user", "test", constants.USER)
+	user, err := store.Login("user", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := user.GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.VerifyRecoveryCode(codes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = persistent.Init(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	user, err = store.Login("user", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.RecoveryCodesLeft() != len(codes)-1 {
+		t.Fatal("recovery codes were not persisted")
+	}
+	if !errors.Is(user.VerifyRecoveryCode(codes[0]), constants.ErrInvalidCode) || user.VerifyRecoveryCode(codes[1]) != nil {
+		t.Fatal("used recovery code was restored or unused one lost")
+	}
+}
@@ -0,0 +1,140 @@
+package test
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/mailer"
+	"github.com/Varppi/goauthy/pkg/memory"
+	"github.com/Varppi/goauthy/pkg/notifier"
+	"github.com/Varppi/goauthy/pkg/persistent"
+	"github.com/Varppi/goauthy/pkg/policy"
+)
+
+// Collects notifications instead of delivering them
+type testNotifier struct {
+	lock          sync.Mutex
+	notifications []notifier.Notification
+}
+
+func (outbox *testNotifier) Notify(notification notifier.Notification) error {
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	outbox.notifications = append(outbox.notifications, notification)
+	return nil
+}
+
+func (outbox *testNotifier) last() notifier.Notification {
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	if len(outbox.notifications) == 0 {
+		return notifier.Notification{}
+	}
+	return outbox.notifications[len(outbox.notifications)-1]
+}
+
+func TestPasswordReset(t *testing.T) {
+	outbox := &testNotifier{}
+	mails := mailer.NewMemory()
+	passwordPolicy := policy.New(policy.MinLength(8))
+	memorySettings := &memory.UserSettings{AllowPasswordChange: true, PasswordResetTTL: 300 * time.Millisecond}
+	persistentSettings := &persistent.UserSettings{AllowPasswordChange: true, PasswordResetTTL: 300 * time.Millisecond}
+	stores := testStores(t,
+		[]memory.Option{memory.WithNotifier(outbox), memory.WithMailer(mails, "https://example.com/auth"), memory.WithPasswordPolicy(passwordPolicy), memory.WithUserSettings(memorySettings)},
+		[]persistent.Option{persistent.WithNotifier(outbox), persistent.WithMailer(mails, "https://example.com/auth"), persistent.WithPasswordPolicy(passwordPolicy), persistent.WithUserSettings(persistentSettings)},
+	)
+	for name, store := range stores {
+		outbox.notifications = nil
+		err := store.Add("user", "original password", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		user, _ := store.UserFromUsername("user")
+		user.SetEmail("user@example.com")
+		session, err := store.Login("user", "original password")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		err = store.RequestPasswordReset("user")
+		if err != nil || len(outbox.notifications) != 0 {
+			t.Fatal(name, "reset was sent to an unverified address", err)
+		}
+		user.SendEmailVerification()
+		err = store.VerifyEmail(mailedToken(t, mails, "user@example.com"))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		err = store.RequestPasswordReset("nobody@example.com")
+		if err != nil || len(outbox.notifications) != 0 {
+			t.Fatal(name, "unknown login was treated differently", err)
+		}
+		store.RequestPasswordReset("user")
+		stale := outbox.last().Token
+		err = store.RequestPasswordReset("USER@example.com")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		notification := outbox.last()
+		if notification.Kind != notifier.PasswordReset || notification.Email != "user@example.com" || notification.Token == stale {
+			t.Fatal(name, "unexpected notification", notification)
+		}
+		if !strings.HasPrefix(notification.Link, "https://example.com/auth/password/reset?token=") {
+			t.Fatal(name, "unexpected reset link", notification.Link)
+		}
+		if store.CheckReset(notification.Token) != nil || !errors.Is(store.CheckReset(stale), constants.ErrInvalidToken) {
+			t.Fatal(name, "reset tokens were checked wrongly")
+		}
+		if !errors.Is(store.RedeemReset(stale, "new password"), constants.ErrInvalidToken) {
+			t.Fatal(name, "replaced reset token still works")
+		}
+		if !errors.Is(store.RedeemReset(notification.Token, "short"), constants.ErrPasswordPolicy) {
+			t.Fatal(name, "reset skipped the password policy")
+		}
+		err = store.RedeemReset(notification.Token, "new password")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !errors.Is(store.RedeemReset(notification.Token, "another password"), constants.ErrInvalidToken) {
+			t.Fatal(name, "reset token could be used twice")
+		}
+		if session.CheckAccess(constants.USER) {
+			t.Fatal(name, "sessions survived the reset")
+		}
+		_, err = store.Login("user", "new password")
+		if err != nil {
+			t.Fatal(name, "new password does not work", err)
+		}
+
+		store.RequestPasswordReset("user")
+		time.Sleep(350 * time.Millisecond)
+		if !errors.Is(store.RedeemReset(outbox.last().Token, "expired password"), constants.ErrInvalidToken) {
+			t.Fatal(name, "expired reset token was accepted")
+		}
+
+		store.RequestPasswordReset("user")
+		moved := outbox.last().Token
+		user.SetEmail("moved@example.com")
+		if !errors.Is(store.CheckReset(moved), constants.ErrInvalidToken) {
+			t.Fatal(name, "reset token survived an email change")
+		}
+		user.SendEmailVerification()
+		store.VerifyEmail(mailedToken(t, mails, "moved@example.com"))
+		store.RequestPasswordReset("user")
+		deleted := outbox.last().Token
+		user, _ = store.UserFromUsername("user")
+		err = user.Delete()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		store.Add("user", "recreated password", constants.USER)
+		if !errors.Is(store.CheckReset(deleted), constants.ErrInvalidToken) {
+			t.Fatal(name, "reset token of a deleted user works for the recreated one")
+		}
+		store.Close()
+	}
+}
@@ -0,0 +1,199 @@
+package test
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/auth"
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/persistent"
+)
+
+func TestRoles(t *testing.T) {
+	for name, store := range testStores(t, nil, nil) {
+		err := store.DefineRole(auth.Role{Name: "billing-admin", Permissions: []string{"billing:refund", "billing:read"}})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if store.DefineRole(auth.Role{Name: "bad role"}) == nil || store.DefineRole(auth.Role{Name: "ok", Permissions: []string{"bad permission"}}) == nil {
+			t.Fatal(name, "malformed role was accepted")
+		}
+		if len(store.Roles()) != 3 {
+			t.Fatal(name, "unexpected roles", store.Roles())
+		}
+
+		store.Add("admin", "test", constants.ADMIN)
+		store.Add("user", "test", constants.USER)
+		admin, _ := store.Login("admin", "test")
+		user, _ := store.Login("user", "test")
+		if !admin.HasPermission("users:delete") || user.HasPermission("billing:refund") {
+			t.Fatal(name, "built-in roles grant the wrong permissions")
+		}
+		err = user.GrantRole(constants.ADMIN_ROLE)
+		if !errors.Is(err, constants.ErrNotAllowed) {
+			t.Fatal(name, "built-in role was granted", err)
+		}
+		err = user.GrantRole("billing-admin")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !slices.Equal(user.Roles(), []string{constants.USER_ROLE, "billing-admin"}) {
+			t.Fatal(name, "unexpected user roles", user.Roles())
+		}
+		if !user.HasPermission("billing:refund") || user.HasPermission("users:delete") {
+			t.Fatal(name, "granted role gives the wrong permissions")
+		}
+
+		store.DefineRole(auth.Role{Name: constants.USER_ROLE, Permissions: []string{"profile:edit"}})
+		if !user.HasPermission("profile:edit") {
+			t.Fatal(name, "built-in role could not be given permissions")
+		}
+		if !errors.Is(store.DeleteRole(constants.USER_ROLE), constants.ErrNotAllowed) {
+			t.Fatal(name, "built-in role was deleted")
+		}
+
+		key, _ := admin.CreateAPIKey("reports", constants.USER, time.Time{})
+		restricted, _ := store.UserFromID(key)
+		if restricted.HasPermission("users:delete") || !restricted.HasPermission("profile:edit") {
+			t.Fatal(name, "API key ceiling did not limit the roles")
+		}
+		token, _ := admin.CreatePersonalToken("cli", []string{"profile:edit"}, time.Time{})
+		scoped, _ := store.UserFromID(token)
+		if !scoped.HasPermission("profile:edit") || scoped.HasPermission("users:delete") {
+			t.Fatal(name, "personal access token was not limited to its scopes")
+		}
+
+		err = store.DeleteRole("billing-admin")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if user.HasPermission("billing:refund") || len(user.Roles()) != 1 {
+			t.Fatal(name, "deleted role still grants permissions")
+		}
+		user.LogOut()
+		store.DefineRole(auth.Role{Name: "support", Permissions: []string{"tickets:read"}})
+		user.GrantRole("support")
+		if user.HasPermission("tickets:read") {
+			t.Fatal(name, "permission granted without a session")
+		}
+		store.Close()
+	}
+}
+
+func TestPersistentRoles(t *testing.T) {
+	database := persistent.WithDatabase(filepath.Join(t.TempDir(), "goauthy.sqlite3"))
+	store, err := persistent.Init(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.DefineRole(auth.Role{Name: "support", Permissions: []string{"tickets:read", "tickets:write"}})
+	store.DefineRole(auth.Role{Name: constants.USER_ROLE, Permissions: []string{"profile:edit"}})
+	store.Add("user", "test", constants.USER)
+	user, _ := store.UserFromUsername("user")
+	err = user.GrantRole("support")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = persistent.Init(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	loaded, err := store.Login("user", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.HasPermission("tickets:write") || !loaded.HasPermission("profile:edit") || loaded.HasPermission("users:delete") {
+		t.Fatal("roles did not survive a restart", loaded.Roles())
+	}
+}
+
+func TestRoleHierarchy(t *testing.T) {
+	for name, store := range testStores(t, nil, nil) {
+		store.DefineRole(auth.Role{Name: "support", Permissions: []string{"tickets:read"}})
+		store.DefineRole(auth.Role{Name: "billing", Permissions: []string{"billing:read"}})
+		err := store.DefineRole(auth.Role{Name: "support-lead", Permissions: []string{"tickets:assign"}, Parents: []string{"support", "billing"}})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		err = store.DefineRole(auth.Role{Name: "manager", Parents: []string{"support-lead", "support"}})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		err = store.DefineRole(auth.Role{Name: "support", Parents: []string{"manager"}})
+		if !errors.Is(err, constants.ErrRoleCycle) {
+			t.Fatal(name, "inheritance cycle was accepted", err)
+		}
+		err = store.DefineRole(auth.Role{Name: "support", Parents: []string{"support"}})
+		if !errors.Is(err, constants.ErrRoleCycle) {
+			t.Fatal(name, "role inheriting from itself was accepted", err)
+		}
+		err = store.DefineRole(auth.Role{Name: "auditor", Parents: []string{"missing"}})
+		if !errors.Is(err, constants.ErrNotFound) {
+			t.Fatal(name, "unknown parent was accepted", err)
+		}
+
+		store.Add("user", "test", constants.USER)
+		user, _ := store.Login("user", "test")
+		user.GrantRole("manager")
+		if !user.HasPermission("tickets:read") || !user.HasPermission("billing:read") || !user.HasPermission("tickets:assign") {
+			t.Fatal(name, "inherited permissions are missing")
+		}
+
+		store.DefineRole(auth.Role{Name: "support", Permissions: []string{"tickets:read", "tickets:close"}})
+		if !user.HasPermission("tickets:close") {
+			t.Fatal(name, "cached permissions survived a role change")
+		}
+		store.DeleteRole("billing")
+		if user.HasPermission("billing:read") {
+			t.Fatal(name, "permissions of a deleted parent are still inherited")
+		}
+		for _, role := range store.Roles() {
+			if role.Name == "support-lead" && !slices.Equal(role.Parents, []string{"support"}) {
+				t.Fatal(name, "deleted parent still listed", role.Parents)
+			}
+		}
+		user.RevokeRole("manager")
+		if user.HasPermission("tickets:read") {
+			t.Fatal(name, "cached permissions survived revoking the role")
+		}
+		user.ChangeAccess(constants.ADMIN)
+		if !user.HasPermission("users:delete") {
+			t.Fatal(name, "cached permissions survived an access change")
+		}
+		store.Close()
+	}
+}
+
+func TestPersistentRoleHierarchy(t *testing.T) {
+	database := persistent.WithDatabase(filepath.Join(t.TempDir(), "goauthy.sqlite3"))
+	store, err := persistent.Init(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.DefineRole(auth.Role{Name: "support", Permissions: []string{"tickets:read"}})
+	store.DefineRole(auth.Role{Name: "support-lead", Parents: []string{"support"}})
+	store.DefineRole(auth.Role{Name: constants.ADMIN_ROLE, Permissions: []string{"*"}, Parents: []string{"support-lead"}})
+	store.Close()
+
+	store, err = persistent.Init(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	err = store.DefineRole(auth.Role{Name: "support", Parents: []string{constants.ADMIN_ROLE}})
+	if !errors.Is(err, constants.ErrRoleCycle) {
+		t.Fatal("hierarchy did not survive a restart", err)
+	}
+	store.Add("user", "test", constants.USER)
+	user, _ := store.Login("user", "test")
+	user.GrantRole("support-lead")
+	if !user.HasPermission("tickets:read") {
+		t.Fatal("inherited permissions are missing after a restart")
+	}
+}
@@ -0,0 +1,237 @@
+package test
+
+import (
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Varppi/goauthy/internal/tokens"
+	"github.com/Varppi/goauthy/pkg/auth"
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/memory"
+	"github.com/Varppi/goauthy/pkg/persistent"
+)
+
+// Builds one store per backend, both silenced and the persistent one backed by a temporary database
+func testStores(t *testing.T, memoryOptions []memory.Option, persistentOptions []persistent.Option) map[string]auth.Store {
+	memoryOptions = append([]memory.Option{memory.WithLogger(log.New(io.Discard, "", 0))}, memoryOptions...)
+	memoryStore, err := memory.Init(memoryOptions...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	persistentOptions = append([]persistent.Option{
+		persistent.WithDatabase(filepath.Join(t.TempDir(), "goauthy.sqlite3")),
+		persistent.WithLogger(log.New(io.Discard, "", 0)),
+	}, persistentOptions...)
+	persistentStore, err := persistent.Init(persistentOptions...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]auth.Store{
+		"memory":     memoryStore,
+		"persistent": persistentStore,
+	}
+}
+
+func TestStoreInterface(t *testing.T) {
+	for name, store := range testStores(t, nil, nil) {
+		err := store.Add("user", "test", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		user, err := store.Login("user", "test")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		session := user.Session()
+		if !tokens.Valid(session, "gas") {
+			t.Fatal(name, "session token is missing its prefix or checksum")
+		}
+		fromSession, err := store.UserFromID(session)
+		if err != nil || fromSession.Username() != "user" {
+			t.Fatal(name, "could not get user from session id")
+		}
+
+		user.LogOut()
+		_, err = store.UserFromID(session)
+		if err == nil {
+			t.Fatal(name, "session still valid after logging out")
+		}
+
+		err = store.Close()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	stores := testStores(t,
+		[]memory.Option{memory.WithUserSettings(&memory.UserSettings{
+			AllowPasswordChange: true,
+			SessionLifetime:     time.Second,
+			SessionIdleTimeout:  200 * time.Millisecond,
+			ReapInterval:        10 * time.Millisecond,
+		})},
+		[]persistent.Option{persistent.WithUserSettings(&persistent.UserSettings{
+			AllowPasswordChange: true,
+			SessionLifetime:     time.Second,
+			SessionIdleTimeout:  200 * time.Millisecond,
+			ReapInterval:        10 * time.Millisecond,
+		})},
+	)
+	for name, store := range stores {
+		err := store.Add("user", "test", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		user, err := store.Login("user", "test")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		session := user.Session()
+		for range 3 {
+			time.Sleep(50 * time.Millisecond)
+			if !user.CheckAccess(constants.USER) {
+				t.Fatal(name, "active session expired before the idle timeout")
+			}
+		}
+		time.Sleep(400 * time.Millisecond)
+		if user.CheckAccess(constants.USER) {
+			t.Fatal(name, "idle session did not expire")
+		}
+		_, err = store.UserFromID(session)
+		if err == nil {
+			t.Fatal(name, "idle session still usable")
+		}
+
+		user, err = store.Login("user", "test")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		session = user.Session()
+		for range 12 {
+			time.Sleep(100 * time.Millisecond)
+			user.CheckAccess(constants.USER)
+		}
+		_, err = store.UserFromID(session)
+		if err == nil {
+			t.Fatal(name, "session outlived its absolute lifetime")
+		}
+
+		err = store.Close()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+	}
+}
+
+func TestSessionListing(t *testing.T) {
+	for name, store := range testStores(t, nil, nil) {
+		err := store.Add("user", "test", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		phone, err := store.LoginWithClient("user", "test", auth.Client{IP: "10.0.0.2", UserAgent: "phone", Device: "my phone"})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		phoneToken := phone.Session()
+		laptop, err := store.LoginWithClient("user", "test", auth.Client{IP: "10.0.0.3", UserAgent: "laptop"})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		sessions, err := laptop.Sessions()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if len(sessions) != 2 {
+			t.Fatal(name, "expected 2 sessions, got", len(sessions))
+		}
+		var phoneSession string
+		for _, session := range sessions {
+			if session.ID == phoneToken || session.ID == laptop.Session() {
+				t.Fatal(name, "session listing leaked a token")
+			}
+			if session.Client.UserAgent == "phone" {
+				phoneSession = session.ID
+			}
+			if session.Current != (session.Client.UserAgent == "laptop") {
+				t.Fatal(name, "wrong session marked as current")
+			}
+			if session.Client.UserAgent == "phone" && (session.Client.Device != "my phone" || session.Client.IP != "10.0.0.2") {
+				t.Fatal(name, "session metadata was not recorded")
+			}
+			if session.Created.IsZero() || session.LastSeen.IsZero() {
+				t.Fatal(name, "session timestamps were not recorded")
+			}
+		}
+
+		err = laptop.RevokeSession(phoneSession)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		_, err = store.UserFromID(phoneToken)
+		if err == nil {
+			t.Fatal(name, "revoked session still usable")
+		}
+		err = laptop.RevokeSession("not a session")
+		if err == nil {
+			t.Fatal(name, "could revoke unknown session")
+		}
+		store.Close()
+	}
+}
+
+func TestHandlesKeepTheirSession(t *testing.T) {
+	for name, store := range testStores(t, nil, nil) {
+		store.Add("user", "test", constants.USER)
+		first, err := store.Login("user", "test")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		firstToken := first.Session()
+		second, err := store.Login("user", "test")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if first.Session() != firstToken || first.Session() == second.Session() {
+			t.Fatal(name, "a later login replaced the session of an earlier handle")
+		}
+
+		lookedUp, err := store.UserFromID(firstToken)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		store.UserFromID(second.Session())
+		if lookedUp.Session() != firstToken {
+			t.Fatal(name, "a later lookup replaced the session of an earlier handle")
+		}
+		sessions, _ := lookedUp.Sessions()
+		for _, session := range sessions {
+			if session.Current != (session.ID == tokens.Hash(firstToken)) {
+				t.Fatal(name, "wrong session marked as current")
+			}
+		}
+
+		err = second.LogOut()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !first.CheckAccess(constants.USER) || second.CheckAccess(constants.USER) {
+			t.Fatal(name, "logging out one handle affected another")
+		}
+		admin, _ := store.UserFromUsername("user")
+		if admin.Session() != "" || admin.CheckAccess(constants.USER) {
+			t.Fatal(name, "handle from UserFromUsername picked up a session")
+		}
+		store.Close()
+	}
+}
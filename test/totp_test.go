@@ -0,0 +1,101 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/totp"
+)
+
+func TestTOTPVectors(t *testing.T) {
+	// RFC 6238 appendix B, SHA1 seed truncated to six digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for seconds, expected := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		code, err := totp.Code(secret, totp.Counter(time.Unix(seconds, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != expected {
+			t.Fatal("wrong code at", seconds, code)
+		}
+	}
+	_, ok := totp.Validate(secret, "287082", time.Unix(89, 0), 1)
+	if !ok {
+		t.Fatal("code within the skew was rejected")
+	}
+	_, ok = totp.Validate(secret, "287082", time.Unix(119, 0), 1)
+	if ok {
+		t.Fatal("code outside the skew was accepted")
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+	for name, store := range testStores(t, nil, nil) {
+		err := store.Add("user", "test", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		user, err := store.Login("user", "test")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		enrollment, err := user.EnrollTOTP()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !strings.HasPrefix(enrollment.URI, "otpauth://totp/goauthy:user?") || !bytes.HasPrefix(enrollment.QR, []byte("\x89PNG")) {
+			t.Fatal(name, "enrollment is missing its URI or QR code")
+		}
+		if user.TOTPEnabled() {
+			t.Fatal(name, "TOTP enabled before confirmation")
+		}
+		counter := totp.Counter(time.Now())
+		code, _ := totp.Code(enrollment.Secret, counter)
+		err = user.ConfirmTOTP(code)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		user.LogOut()
+
+		user, err = store.Login("user", "test")
+		if !errors.Is(err, constants.ErrMFARequired) {
+			t.Fatal(name, "login did not ask for the second factor", err)
+		}
+		if user.CheckAccess(constants.USER) {
+			t.Fatal(name, "pending session could be used")
+		}
+		if user.ChangePassword("other") == nil {
+			t.Fatal(name, "pending session could change the password")
+		}
+		pending, err := store.UserFromID(user.Session())
+		if err != nil {
+			t.Fatal(name, "pending session could not be resumed", err)
+		}
+		err = pending.VerifyTOTP(code)
+		if !errors.Is(err, constants.ErrInvalidCode) {
+			t.Fatal(name, "replayed code was accepted", err)
+		}
+		next, _ := totp.Code(enrollment.Secret, counter+1)
+		err = pending.VerifyTOTP(next)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !pending.CheckAccess(constants.USER) {
+			t.Fatal(name, "session still pending after a valid code")
+		}
+
+		err = pending.DisableTOTP()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		_, err = store.Login("user", "test")
+		if err != nil {
+			t.Fatal(name, "login still asks for a code after disabling TOTP", err)
+		}
+		store.Close()
+	}
+}
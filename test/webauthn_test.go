@@ -0,0 +1,331 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Varppi/goauthy/pkg/auth"
+	"github.com/Varppi/goauthy/pkg/constants"
+	"github.com/Varppi/goauthy/pkg/memory"
+	"github.com/Varppi/goauthy/pkg/persistent"
+	"github.com/Varppi/goauthy/pkg/totp"
+	"github.com/Varppi/goauthy/pkg/webauthn"
+)
+
+var relyingParty = &webauthn.RelyingParty{ID: "example.com", Name: "Example", Origins: []string{"https://example.com"}}
+
+// Minimal CBOR encoder for building authenticator responses, maps keep their order
+type cborMap [][2]any
+
+func encodeCBOR(value any) []byte {
+	header := func(major byte, argument uint64) []byte {
+		switch {
+		case argument < 24:
+			return []byte{major<<5 | byte(argument)}
+		case argument < 1<<8:
+			return []byte{major<<5 | 24, byte(argument)}
+		default:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(argument))
+		}
+	}
+	switch value := value.(type) {
+	case int:
+		if value < 0 {
+			return header(1, uint64(-1-value))
+		}
+		return header(0, uint64(value))
+	case []byte:
+		return append(header(2, uint64(len(value))), value...)
+	case string:
+		return append(header(3, uint64(len(value))), value...)
+	case []any:
+		encoded := header(4, uint64(len(value)))
+		for _, item := range value {
+			encoded = append(encoded, encodeCBOR(item)...)
+		}
+		return encoded
+	case cborMap:
+		encoded := header(5, uint64(len(value)))
+		for _, pair := range value {
+			encoded = append(encoded, encodeCBOR(pair[0])...)
+			encoded = append(encoded, encodeCBOR(pair[1])...)
+		}
+		return encoded
+	}
+	panic("unsupported cbor value")
+}
+
+// Software authenticator holding one ES256 credential
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	id           []byte
+	counter      uint32
+	origin       string
+	presenceOnly bool // assert without verifying the user
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, id: id, origin: "https://example.com"}
+}
+
+func (authenticator *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": authenticator.origin})
+	return data
+}
+
+func (authenticator *softAuthenticator) authData(rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags := byte(0x01 | 0x04)
+	if authenticator.presenceOnly {
+		flags = 0x01
+	}
+	if attested {
+		flags |= 0x40
+	}
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, authenticator.counter)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(authenticator.id)))
+		data = append(data, authenticator.id...)
+		data = append(data, encodeCBOR(cborMap{
+			{1, 2}, {3, -7}, {-1, 1},
+			{-2, authenticator.key.X.FillBytes(make([]byte, 32))},
+			{-3, authenticator.key.Y.FillBytes(make([]byte, 32))},
+		})...)
+	}
+	return data
+}
+
+func (authenticator *softAuthenticator) sign(authData, clientData []byte) []byte {
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, _ := ecdsa.SignASN1(rand.Reader, authenticator.key, digest[:])
+	return signature
+}
+
+func (authenticator *softAuthenticator) register(options webauthn.CreationOptions, format string) webauthn.RegistrationResponse {
+	clientData := authenticator.clientData("webauthn.create", options.Challenge)
+	authData := authenticator.authData(options.RP.ID, true)
+	statement := cborMap{}
+	if format == "packed" {
+		statement = cborMap{{"alg", -7}, {"sig", authenticator.sign(authData, clientData)}}
+	}
+	response := webauthn.RegistrationResponse{ID: base64.RawURLEncoding.EncodeToString(authenticator.id), Type: "public-key"}
+	response.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientData)
+	response.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(encodeCBOR(cborMap{
+		{"fmt", format}, {"attStmt", statement}, {"authData", authData},
+	}))
+	return response
+}
+
+func (authenticator *softAuthenticator) assert(options webauthn.RequestOptions) webauthn.AssertionResponse {
+	authenticator.counter++
+	clientData := authenticator.clientData("webauthn.get", options.Challenge)
+	authData := authenticator.authData(options.RPID, false)
+	response := webauthn.AssertionResponse{ID: base64.RawURLEncoding.EncodeToString(authenticator.id), Type: "public-key"}
+	response.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientData)
+	response.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	response.Response.Signature = base64.RawURLEncoding.EncodeToString(authenticator.sign(authData, clientData))
+	return response
+}
+
+func TestPasskeys(t *testing.T) {
+	stores := testStores(t,
+		[]memory.Option{memory.WithWebAuthn(relyingParty)},
+		[]persistent.Option{persistent.WithWebAuthn(relyingParty)},
+	)
+	for name, store := range stores {
+		err := store.Add("user", "test", constants.USER)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		user, err := store.Login("user", "test")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		for _, format := range []string{"none", "packed"} {
+			authenticator := newSoftAuthenticator(t)
+			options, err := user.BeginPasskeyRegistration()
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			err = user.FinishPasskeyRegistration(format, authenticator.register(options, format))
+			if err != nil {
+				t.Fatal(name, format, err)
+			}
+		}
+		passkeys, err := user.Passkeys()
+		if err != nil || len(passkeys) != 2 || passkeys[1].Attestation != "packed" {
+			t.Fatal(name, "passkeys were not registered", passkeys, err)
+		}
+
+		phishing := newSoftAuthenticator(t)
+		phishing.origin = "https://example.com.evil"
+		options, _ := user.BeginPasskeyRegistration()
+		err = user.FinishPasskeyRegistration("phished", phishing.register(options, "none"))
+		if !errors.Is(err, webauthn.ErrInvalidClientData) {
+			t.Fatal(name, "registration from a foreign origin was accepted", err)
+		}
+		err = user.FinishPasskeyRegistration("replayed", phishing.register(options, "none"))
+		if !errors.Is(err, constants.ErrInvalidChallenge) {
+			t.Fatal(name, "challenge could be answered twice", err)
+		}
+
+		authenticator := newSoftAuthenticator(t)
+		options, _ = user.BeginPasskeyRegistration()
+		err = user.FinishPasskeyRegistration("laptop", authenticator.register(options, "none"))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		user.LogOut()
+
+		request, err := store.BeginPasskeyLogin("user")
+		if err != nil || len(request.AllowCredentials) != 3 {
+			t.Fatal(name, "login options do not list the passkeys", err)
+		}
+		passkeyUser, err := store.FinishPasskeyLogin(authenticator.assert(request), auth.Client{})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !passkeyUser.CheckAccess(constants.USER) {
+			t.Fatal(name, "passkey login did not create a session")
+		}
+		passkeyUser.LogOut()
+
+		// discoverable passkey, the counter going backwards hints at a cloned authenticator
+		request, _ = store.BeginPasskeyLogin("")
+		authenticator.counter--
+		_, err = store.FinishPasskeyLogin(authenticator.assert(request), auth.Client{})
+		if !errors.Is(err, webauthn.ErrCounterRegressed) {
+			t.Fatal(name, "regressed signature counter was accepted", err)
+		}
+		store.Close()
+	}
+}
+
+func TestPasskeySecondFactor(t *testing.T) {
+	stores := testStores(t,
+		[]memory.Option{memory.WithWebAuthn(relyingParty), memory.WithUserSettings(&memory.UserSettings{LockoutThreshold: 2, LockoutDuration: time.Hour})},
+		[]persistent.Option{persistent.WithWebAuthn(relyingParty), persistent.WithUserSettings(&persistent.UserSettings{LockoutThreshold: 2, LockoutDuration: time.Hour})},
+	)
+	for name, store := range stores {
+		store.Add("user", "test", constants.USER)
+		user, _ := store.Login("user", "test")
+		authenticator := newSoftAuthenticator(t)
+		creation, _ := user.BeginPasskeyRegistration()
+		err := user.FinishPasskeyRegistration("laptop", authenticator.register(creation, "none"))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		enrollment, _ := user.EnrollTOTP()
+		code, _ := totp.Code(enrollment.Secret, totp.Counter(time.Now()))
+		err = user.ConfirmTOTP(code)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		authenticator.presenceOnly = true
+		request, _ := store.BeginPasskeyLogin("user")
+		pending, err := store.FinishPasskeyLogin(authenticator.assert(request), auth.Client{})
+		if !errors.Is(err, constants.ErrMFARequired) || pending.CheckAccess(constants.USER) {
+			t.Fatal(name, "passkey without user verification skipped TOTP", err)
+		}
+		authenticator.presenceOnly = false
+		request, _ = store.BeginPasskeyLogin("user")
+		_, err = store.FinishPasskeyLogin(authenticator.assert(request), auth.Client{})
+		if err != nil {
+			t.Fatal(name, "verified passkey did not count as two factors", err)
+		}
+
+		for range 2 {
+			request, _ = store.BeginPasskeyLogin("user")
+			authenticator.counter--
+			store.FinishPasskeyLogin(authenticator.assert(request), auth.Client{})
+		}
+		request, _ = store.BeginPasskeyLogin("user")
+		_, err = store.FinishPasskeyLogin(authenticator.assert(request), auth.Client{})
+		if !errors.Is(err, constants.ErrAccountLocked) {
+			t.Fatal(name, "failed assertions did not count as failed logins", err)
+		}
+
+		for range 10001 {
+			_, err = store.BeginPasskeyLogin("")
+			if err != nil {
+				break
+			}
+		}
+		if !errors.Is(err, constants.ErrTooManyChallenges) {
+			t.Fatal(name, "pending challenges were not capped", err)
+		}
+		store.Close()
+	}
+}
+
+func TestPersistentPasskeys(t *testing.T) {
+	options := []persistent.Option{
+		persistent.WithDatabase(filepath.Join(t.TempDir(), "goauthy.sqlite3")),
+		persistent.WithLogger(log.New(io.Discard, "", 0)),
+		persistent.WithWebAuthn(relyingParty),
+	}
+	store, err := persistent.Init(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add("user", "test", constants.USER)
+	user, err := store.Login("user", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := newSoftAuthenticator(t)
+	creation, _ := user.BeginPasskeyRegistration()
+	err = user.FinishPasskeyRegistration("laptop", authenticator.register(creation, "packed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _ := store.BeginPasskeyLogin("user")
+	_, err = store.FinishPasskeyLogin(authenticator.assert(request), auth.Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = persistent.Init(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	request, _ = store.BeginPasskeyLogin("")
+	authenticator.counter--
+	_, err = store.FinishPasskeyLogin(authenticator.assert(request), auth.Client{})
+	if !errors.Is(err, webauthn.ErrCounterRegressed) {
+		t.Fatal("signature counter was not persisted", err)
+	}
+	request, _ = store.BeginPasskeyLogin("")
+	user, err = store.FinishPasskeyLogin(authenticator.assert(request), auth.Client{})
+	if err != nil {
+		t.Fatal("passkey did not survive a restart", err)
+	}
+	passkeys, _ := user.Passkeys()
+	if len(passkeys) != 1 || passkeys[0].Name != "laptop" || passkeys[0].LastUsed.IsZero() {
+		t.Fatal("passkey metadata was not persisted", passkeys)
+	}
+}